@@ -5,21 +5,17 @@ go 1.23.5
 require (
 	github.com/bogem/id3v2 v1.2.0
 	github.com/mmcdole/gofeed v1.3.0
-	gopkg.in/cheggaaa/pb.v1 v1.0.28
+	golang.org/x/sync v0.10.0
+	golang.org/x/sys v0.29.0
 )
 
 require (
 	github.com/PuerkitoBio/goquery v1.8.0 // indirect
 	github.com/andybalholm/cascadia v1.3.1 // indirect
-	github.com/fatih/color v1.18.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/mattn/go-colorable v0.1.14 // indirect
-	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/mmcdole/goxpp v1.1.1-0.20240225020742-a0c311522b23 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	github.com/rivo/uniseg v0.2.0 // indirect
 	golang.org/x/net v0.4.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 )
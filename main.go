@@ -1,247 +1,575 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"sync"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bogem/id3v2"
-	"github.com/mmcdole/gofeed"
+	"github.com/davidroman0O/go-musicforprogramming/mfp"
 )
 
-// Episode represents a podcast episode with a reformatted title.
-type Episode struct {
-	Number string
-	Title  string
-	URL    string
-}
-
-// Downloader manages the downloading and tagging process.
-type Downloader struct {
-	OutputDir string
-	FeedURL   string
-	CoverURL  string
-	Episodes  []Episode
-}
-
-// newDownloader creates a new Downloader instance.
-func newDownloader(outDir, feedURL, coverURL string) *Downloader {
-	return &Downloader{
-		OutputDir: outDir,
-		FeedURL:   feedURL,
-		CoverURL:  coverURL,
-	}
-}
-
 func main() {
+	feedURL := flag.String("feed", mfp.DefaultFeedURL, "RSS feed URL, local file, or - for stdin")
+	coverBack := flag.String("cover-back", "", "back cover image (JPEG or PNG) embedded in every episode, as a URL or a local file path")
+	perEpisodeArt := flag.Bool("per-episode-art", false, "embed each episode's own artwork from the feed (itunes:image) instead of -cover, when it has one")
+	checkCover := flag.Bool("check-cover", false, "re-tag files whose embedded cover isn't the current cover image")
+	noCover := flag.Bool("no-cover", false, "don't fetch or embed any cover image")
+	coverURL := flag.String("cover", mfp.DefaultCoverURL, "cover image URL or local file")
+	concurrency := flag.String("concurrency", strconv.Itoa(mfp.DefaultConcurrency), `number of episodes to process in parallel, or "auto"`)
+	tagConcurrency := flag.Int("concurrency-tagging", 0, "number of episodes to tag in parallel (0: same as -concurrency)")
+	retries := flag.Int("retries", mfp.DefaultRetries, "number of retries on transient network errors")
+	retryJitter := flag.Float64("retry-jitter", mfp.DefaultRetryJitter, "randomize retry delays by up to this fraction, from 0 to 1")
+	artist := flag.String("artist", "", "artist tag for every episode (default: the feed author)")
+	albumArtist := flag.String("album-artist", "", "album artist tag for every episode (default: -artist, then the feed author)")
+	album := flag.String("album", mfp.DefaultAlbum, "album tag for every episode")
+	dryRun := flag.Bool("dry-run", false, "list what would be downloaded without downloading")
+	playlist := flag.Bool("playlist", false, "write a playlist.m3u8 of the downloaded episodes")
+	var output string
+	flag.StringVar(&output, "output", "", "output directory (overrides the positional argument)")
+	flag.StringVar(&output, "o", "", "shorthand for -output")
+	episode := flag.Int("episode", 0, "only process this episode number")
+	from := flag.Int("from", 0, "first episode number to download (0 for no lower bound)")
+	to := flag.Int("to", 0, "last episode number to download (0 for no upper bound)")
+	order := flag.String("order", mfp.OrderAsc, "episode order: asc (oldest first), desc (newest first) or feed")
+	since := flag.String("since", "", "only download episodes published on or after this date, e.g. 2023-01-01")
+	includeUndated := flag.Bool("include-undated", false, "with -since, also download episodes that have no date")
+	maxTotalSize := flag.String("max-total-size", "", "stop starting downloads once this many bytes are queued in the run, e.g. 500m or 2g")
+	limit := flag.Int("limit", 0, "only download the N most recent episodes (0 for all)")
+	force := flag.Bool("force", false, "ignore the state file and low disk space, re-verify every episode, and let -clean delete without asking")
+	forceUnlock := flag.Bool("force-unlock", false, "remove the lock left in the output directory by a run that crashed")
+	rateLimit := flag.String("rate-limit", "", "combined download speed cap in bytes/sec, e.g. 500k or 2m")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	quiet := flag.Bool("quiet", false, "only print errors and the final summary")
+	verbose := flag.Bool("verbose", false, "print debug output including per-chunk download progress")
+	jsonLogs := flag.Bool("json-logs", false, "write logs as JSON")
+	tui := flag.Bool("tui", false, "show a full-screen dashboard of the downloads instead of log lines")
+	verify := flag.Bool("verify", false, "re-tag existing files with missing metadata without downloading, then exit")
+	userAgent := flag.String("user-agent", mfp.DefaultUserAgent, "User-Agent header sent with every request")
+	titleRegex := flag.String("title-regex", "", "regex with (?P<number>) and (?P<title>) groups to parse episode titles")
+	nameTemplate := flag.String("name-template", mfp.DefaultNameTemplate, "filename template using {{.Number}}, {{.Title}}, {{.Year}} and {{.Ext}}")
+	maxRedirects := flag.Int("max-redirects", mfp.DefaultRedirects, "maximum number of redirects to follow per request")
+	downloadTimeout := flag.Duration("download-timeout", 0, "maximum time a single episode download may take (0 for no limit)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9090")
+	feedAuth := flag.String("feed-auth", "", "user:password for a feed behind basic auth, also sent to enclosures on the feed's host")
+	bearerToken := flag.String("bearer-token", "", "bearer token for a private feed, also sent to enclosures on the feed's host")
+	maxIdleConns := flag.Int("max-idle-conns-per-host", mfp.DefaultMaxIdleConnsPerHost, "idle connections kept open per host for reuse")
+	proxy := flag.String("proxy", "", "HTTP or HTTPS proxy URL (default: the HTTP_PROXY/HTTPS_PROXY environment variables)")
+	caCert := flag.String("ca-cert", "", "PEM file with extra CA certificates to trust, e.g. for a self-hosted mirror")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification (unsafe)")
+	noCache := flag.Bool("no-cache", false, "always download the full feed instead of revalidating the cached copy")
+	dirMode := flag.String("dir-mode", fmt.Sprintf("%04o", mfp.DefaultDirMode), "octal permissions of created directories, before the umask, e.g. 0700")
+	fileMode := flag.String("file-mode", fmt.Sprintf("%04o", mfp.DefaultFileMode), "octal permissions of created files, before the umask, e.g. 0600")
+	byYear := flag.Bool("output-by-year", false, "store episodes in per-year subdirectories instead of a flat directory")
+	preferFormat := flag.String("prefer-format", "mp3", "enclosure format to pick when an episode has several, e.g. m4a or audio/ogg")
+	allowTypes := flag.String("allow-types", strings.Join(mfp.DefaultAllowedTypes, ","), "comma-separated enclosure MIME types to download, e.g. audio/mpeg,audio/*")
+	checkContentType := flag.Bool("check-content-type", false, "also check each download's Content-Type against -allow-types before saving it")
+	resumeAll := flag.Bool("resume-all", false, "finish every partial download left in the output directory first, even outside the selected episodes")
+	interactive := flag.Bool("interactive", false, "list the episodes and ask which ones to download")
+	chapters := flag.Bool("chapters", false, "write chapter markers from the feed or a <name>.chapters.json file")
+	tagPadding := flag.String("tag-padding", strconv.Itoa(mfp.DefaultTagPadding), "space to reserve after the ID3v2 tag so later retags don't rewrite the file, e.g. 64k")
+	checkRemoteSize := flag.Bool("check-remote-size", false, "re-download episodes whose size on the server changed (one HEAD request per episode)")
+	strictTags := flag.Bool("strict-tags", false, "fail episodes that can't be fully tagged and require every tag to be present")
+	appendToComment := flag.String("append-to-comment", "", "extra information to append to the comment tag: url, the enclosure URL")
+	id3v1 := flag.Bool("id3v1", false, "also write ID3v1 tags for old players")
+	verifyChecksums := flag.Bool("verify-checksums", false, "check downloaded files against SHA256SUMS without downloading anything")
+	retagAlbum := flag.String("retag-album", "", "change the album of files tagged with this album to -album, then exit")
+	onComplete := flag.String("on-complete", "", "shell command to run after each episode is downloaded, with EPISODE_NUMBER, EPISODE_TITLE and EPISODE_PATH set")
+	clean := flag.Bool("clean", false, "list files in the output directory that are no longer in the feed and offer to delete them, then exit")
+	exportOPML := flag.String("export-opml", "", "write an OPML subscription to the feed to this file (- for stdout) and exit")
+	list := flag.Bool("list", false, "print a table of the feed's episodes and whether each one is downloaded, then exit")
+	listJSON := flag.String("list-json", "", "write the episode list as JSON to this file (- for stdout) and exit")
+	timeout := flag.Duration("timeout", mfp.DefaultTimeout, "timeout for feed and cover requests, and for a stalled download (0 to disable)")
 	flag.Parse()
-	// Use the first positional argument as the output directory, if provided.
-	outputDir := "downloaded_music"
-	if flag.NArg() > 0 {
-		outputDir = flag.Arg(0)
+	workers := 0 // Auto.
+	if *concurrency != "auto" {
+		n, err := strconv.Atoi(*concurrency)
+		if err != nil || n < 1 {
+			fatalf("Invalid -concurrency %q: must be at least 1 or \"auto\"", *concurrency)
+		}
+		workers = n
 	}
-
-	d := newDownloader(outputDir,
-		"https://musicforprogramming.net/rss.php",
-		"https://musicforprogramming.net/img/folder.jpg")
-
-	if err := d.prepareOutput(); err != nil {
-		log.Fatalf("Error preparing output directory: %v", err)
+	if *tagConcurrency < 0 {
+		fatalf("Invalid -concurrency-tagging %d: must not be negative", *tagConcurrency)
 	}
-	if err := d.fetchCover(); err != nil {
-		log.Fatalf("Error fetching cover: %v", err)
+	if *retries < 0 {
+		fatalf("Invalid -retries %d: must not be negative", *retries)
 	}
-	if err := d.loadEpisodes(); err != nil {
-		log.Fatalf("Error loading episodes: %v", err)
+	if *retryJitter < 0 || *retryJitter > 1 {
+		fatalf("Invalid -retry-jitter %v: must be between 0 and 1", *retryJitter)
+	}
+	if *limit < 0 {
+		fatalf("Invalid -limit %d: must not be negative", *limit)
+	}
+	switch *order {
+	case mfp.OrderAsc, mfp.OrderDesc, mfp.OrderFeed:
+	default:
+		fatalf("Invalid -order %q: must be asc, desc or feed", *order)
+	}
+	if *maxIdleConns < 1 {
+		fatalf("Invalid -max-idle-conns-per-host %d: must be at least 1", *maxIdleConns)
+	}
+	if *episode < 0 {
+		fatalf("Invalid -episode %d: must not be negative", *episode)
+	}
+	d := mfp.NewDownloader(outputDirectory(output, flag.Args()), *feedURL, *coverURL)
+	d.Concurrency = workers
+	d.TagConcurrency = *tagConcurrency
+	d.Retries = *retries
+	d.RetryJitter = *retryJitter
+	d.Artist = *artist
+	d.Album = *album
+	d.AlbumArtist = *albumArtist
+	d.DryRun = *dryRun
+	d.Playlist = *playlist
+	d.From, d.To = *from, *to
+	d.Only = *episode
+	d.Timeout = *timeout
+	d.DownloadTimeout = *downloadTimeout
+	d.Limit = *limit
+	d.Order = *order
+	d.Force = *force
+	d.JSONLogs = *jsonLogs
+	d.UserAgent = *userAgent
+	d.MaxRedirects = *maxRedirects
+	d.NoCache = *noCache
+	d.ByYear = *byYear
+	d.ID3v1 = *id3v1
+	d.Chapters = *chapters
+	d.StrictTags = *strictTags
+	d.CheckRemoteSize = *checkRemoteSize
+	tmpl, err := mfp.ParseNameTemplate(*nameTemplate)
+	if err != nil {
+		fatalf("Invalid -name-template: %v", err)
+	}
+	d.NameTemplate = tmpl
+	if *titleRegex != "" {
+		re, err := mfp.CompileTitleRegex(*titleRegex)
+		if err != nil {
+			fatalf("Invalid -title-regex: %v", err)
+		}
+		d.TitleRegex = re
+	}
+	if err := d.LogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatalf("Invalid -log-level %q: %v", *logLevel, err)
+	}
+	switch {
+	case *quiet && *verbose:
+		fatalf("-quiet and -verbose can't be used together")
+	case *quiet:
+		d.LogLevel = slog.LevelError
+	case *verbose:
+		d.LogLevel = mfp.LevelTrace
+	}
+	if *rateLimit != "" {
+		limit, err := mfp.ParseSize(*rateLimit)
+		if err != nil || limit < 1 {
+			fatalf("Invalid -rate-limit %q", *rateLimit)
+		}
+		d.RateLimit = limit
+	}
+	if *maxTotalSize != "" {
+		size, err := mfp.ParseSize(*maxTotalSize)
+		if err != nil || size < 1 {
+			fatalf("Invalid -max-total-size %q", *maxTotalSize)
+		}
+		d.MaxTotalSize = size
+	}
+	padding, err := mfp.ParseSize(*tagPadding)
+	if err != nil {
+		fatalf("Invalid -tag-padding %q", *tagPadding)
+	}
+	d.TagPadding = padding
+	d.DirMode = parseMode("-dir-mode", *dirMode, 0700)
+	d.FileMode = parseMode("-file-mode", *fileMode, 0600)
+	if _, ok := mfp.FormatExtension(*preferFormat); !ok {
+		fatalf("Invalid -prefer-format %q: not a known audio format", *preferFormat)
+	}
+	d.PreferFormat = *preferFormat
+	for _, t := range strings.Split(*allowTypes, ",") {
+		t = strings.TrimSpace(t)
+		if _, _, err := mime.ParseMediaType(t); err != nil || !strings.Contains(t, "/") {
+			fatalf("Invalid -allow-types %q: %q is not a MIME type like audio/mpeg or audio/*", *allowTypes, t)
+		}
+		d.AllowedTypes = append(d.AllowedTypes, t)
+	}
+	d.ResumeAll = *resumeAll
+	d.CheckContentType = *checkContentType
+	if *since != "" {
+		t, err := time.Parse(time.DateOnly, *since)
+		if err != nil {
+			fatalf("Invalid -since %q: must be a date like 2023-01-01", *since)
+		}
+		d.Since = t
+	}
+	d.IncludeUndated = *includeUndated
+	switch *appendToComment {
+	case "":
+	case "url":
+		d.CommentURL = true
+	default:
+		fatalf("Invalid -append-to-comment %q: must be url", *appendToComment)
+	}
+	d.PerEpisodeArt = *perEpisodeArt
+	d.NoCover = *noCover
+	d.CheckCover = *checkCover
+	if *coverBack != "" {
+		d.Artwork = append(d.Artwork, mfp.Artwork{Source: *coverBack, PictureType: id3v2.PTBackCover, Description: "Back cover"})
+	}
+	if *interactive && *feedURL == "-" {
+		fatalf("-interactive can't be used with -feed -, both read stdin")
+	}
+	// The dashboard takes over the screen for the whole run, which would
+	// hide the selection prompt and the dry-run plan.
+	if *tui && *interactive {
+		fatalf("-tui can't be used with -interactive, the dashboard would cover the prompt")
+	}
+	if *tui && *dryRun {
+		fatalf("-tui can't be used with -dry-run, the dashboard would wipe the plan")
+	}
+	if *interactive {
+		d.Select = promptSelection
+	}
+	if *onComplete != "" {
+		d.OnComplete = func(ctx context.Context, ep mfp.Episode, path string) error {
+			return runHook(ctx, *onComplete, ep, path)
+		}
+	}
+	switch {
+	case *feedAuth != "" && *bearerToken != "":
+		fatalf("-feed-auth and -bearer-token can't be used together")
+	case *feedAuth != "":
+		user, password, ok := strings.Cut(*feedAuth, ":")
+		if !ok || user == "" {
+			fatalf("Invalid -feed-auth: must be user:password")
+		}
+		d.FeedAuth = url.UserPassword(user, password)
+	case *bearerToken != "":
+		d.BearerToken = *bearerToken
+	}
+	// Set before the first request, while nothing else uses the transport.
+	d.Client.Transport.(*http.Transport).MaxIdleConnsPerHost = *maxIdleConns
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			fatalf("Invalid -proxy %q: must be an http:// or https:// URL", *proxy)
+		}
+		d.Proxy = u
+	}
+	if *caCert != "" {
+		pem, err := os.ReadFile(*caCert)
+		if err != nil {
+			fatalf("Invalid -ca-cert: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			fatalf("Invalid -ca-cert %q: no PEM certificates found", *caCert)
+		}
+		d.RootCAs = pool
+	}
+	if *insecure {
+		log.Println("WARNING: -insecure disables TLS certificate verification; anyone on the network can impersonate the feed and serve you anything.")
+		d.Insecure = true
 	}
-	d.downloadAndTagEpisodes()
-}
 
-// prepareOutput ensures the output directory exists.
-func (d *Downloader) prepareOutput() error {
-	return os.MkdirAll(d.OutputDir, 0755)
-}
+	if *metricsAddr != "" {
+		d.Metrics = mfp.NewMetrics()
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			fatalf("Invalid -metrics-addr %q: %v", *metricsAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", d.Metrics)
+		go http.Serve(ln, mux)
+	}
 
-// fetchCover downloads the cover image if it doesn't already exist.
-func (d *Downloader) fetchCover() error {
-	coverPath := filepath.Join(d.OutputDir, "cover.jpg")
-	if _, err := os.Stat(coverPath); err == nil {
-		return nil // Cover already exists.
+	// Cancel in-flight work on Ctrl-C so partial downloads get cleaned up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *forceUnlock {
+		if err := d.ForceUnlock(); err != nil {
+			fatalf("Error: %v", err)
+		}
 	}
 
-	resp, err := http.Get(d.CoverURL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch cover: %w", err)
+	if *listJSON != "" {
+		if err := export(*listJSON, func(w io.Writer) error { return d.ExportJSON(ctx, w) }); err != nil {
+			fatalf("Error: %v", err)
+		}
+		return
 	}
-	defer resp.Body.Close()
 
-	out, err := os.Create(coverPath)
-	if err != nil {
-		return fmt.Errorf("failed to create cover file: %w", err)
+	if *list {
+		if err := printList(ctx, d); err != nil {
+			fatalf("Error: %v", err)
+		}
+		return
 	}
-	defer out.Close()
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return fmt.Errorf("failed to write cover file: %w", err)
+	if *exportOPML != "" {
+		if err := export(*exportOPML, func(w io.Writer) error { return d.ExportOPML(ctx, w) }); err != nil {
+			fatalf("Error: %v", err)
+		}
+		return
 	}
-	log.Println("Cover image downloaded.")
-	return nil
-}
 
-// loadEpisodes parses the RSS feed and creates a list of episodes,
-// reformatting titles from "Episode XX: Title" to "XX - Title".
-func (d *Downloader) loadEpisodes() error {
-	parser := gofeed.NewParser()
-	feed, err := parser.ParseURL(d.FeedURL)
-	if err != nil {
-		return fmt.Errorf("failed to parse feed: %w", err)
+	if *retagAlbum != "" {
+		if err := d.RetagAlbum(ctx, *retagAlbum); err != nil {
+			exitOnError(err)
+		}
+		return
 	}
 
-	re := regexp.MustCompile(`^Episode\s+(\d+):\s*(.+)$`)
-	for _, item := range feed.Items {
-		if len(item.Enclosures) == 0 {
-			continue
+	if *clean {
+		if err := cleanOrphans(ctx, d, *force); err != nil {
+			fatalf("Error: %v", err)
 		}
-		matches := re.FindStringSubmatch(item.Title)
-		if len(matches) != 3 {
-			log.Printf("Unrecognized title format, skipping: %s", item.Title)
-			continue
+		return
+	}
+
+	if *verifyChecksums {
+		if err := d.VerifyChecksums(ctx); err != nil {
+			exitOnError(err)
 		}
-		ep := Episode{
-			Number: matches[1],
-			Title:  matches[2],
-			URL:    item.Enclosures[0].URL,
+		return
+	}
+
+	if *verify {
+		if err := d.Verify(ctx); err != nil {
+			exitOnError(err)
 		}
-		d.Episodes = append(d.Episodes, ep)
+		return
 	}
 
-	// Reverse the order so the earliest episode comes first.
-	for i, j := 0, len(d.Episodes)-1; i < j; i, j = i+1, j-1 {
-		d.Episodes[i], d.Episodes[j] = d.Episodes[j], d.Episodes[i]
+	if *tui && !canDraw(os.Stderr) {
+		log.Println("-tui needs a terminal, falling back to plain logs")
+		*tui = false
+	}
+	var dash *dashboard
+	if *tui {
+		dash = newDashboard(os.Stderr)
+		d.Progress = dash.events
+		d.LogOutput = dash
+	}
+	err = d.Run(ctx)
+	if dash != nil {
+		dash.Close()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Println("Interrupted, stopped before all episodes were processed.")
+			os.Exit(exitFailed)
+		}
+		exitOnError(err)
 	}
-	log.Printf("Found %d episodes.", len(d.Episodes))
-	return nil
 }
 
-// downloadAndTagEpisodes processes episodes concurrently.
-// If a file already exists, it checks its metadata. If metadata is incomplete,
-// it updates the metadata without re-downloading.
-func (d *Downloader) downloadAndTagEpisodes() {
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 3) // Limit concurrent processing to 3.
-	coverPath := filepath.Join(d.OutputDir, "cover.jpg")
-
-	for _, ep := range d.Episodes {
-		wg.Add(1)
-		sem <- struct{}{}
-		go func(ep Episode) {
-			defer wg.Done()
-			defer func() { <-sem }()
-
-			// Create a filename of the form "XX - Title.mp3"
-			fileName := fmt.Sprintf("%s - %s.mp3", ep.Number, ep.Title)
-			targetPath := filepath.Join(d.OutputDir, fileName)
-
-			// Check if the file exists.
-			if _, err := os.Stat(targetPath); err == nil {
-				// File exists, so check if its metadata is complete.
-				metaOk, err := metadataComplete(targetPath)
-				if err != nil {
-					log.Printf("Error reading metadata for '%s': %v", fileName, err)
-				}
-				if metaOk {
-					log.Printf("Episode '%s' is already complete.", fileName)
-					return
-				}
-				// Update metadata if incomplete.
-				log.Printf("File '%s' exists but metadata is incomplete. Updating metadata...", fileName)
-				if err := tagEpisode(targetPath, coverPath); err != nil {
-					log.Printf("Error updating metadata for '%s': %v", fileName, err)
-				} else {
-					log.Printf("Metadata updated for '%s'.", fileName)
-				}
-				return
-			}
+// Exit codes, so scripts can tell a partial failure from a broken setup.
+const (
+	exitFailed = 1 // Some episodes failed, or the run was interrupted.
+	exitFatal  = 2 // Bad flags, or the run couldn't get going, e.g. the feed is unreachable.
+)
 
-			// File doesn't exist; download and tag.
-			log.Printf("Downloading episode '%s'...", fileName)
-			if err := downloadFile(ep.URL, targetPath); err != nil {
-				log.Printf("Error downloading '%s': %v", fileName, err)
-				return
-			}
-			if err := tagEpisode(targetPath, coverPath); err != nil {
-				log.Printf("Error tagging '%s': %v", fileName, err)
-				return
-			}
-			log.Printf("Episode '%s' processed.", fileName)
-		}(ep)
+// fatalf logs the message and exits with exitFatal.
+func fatalf(format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(exitFatal)
+}
+
+// defaultOutputDir is where episodes go when no directory is given.
+const defaultOutputDir = "downloaded_music"
+
+// outputDirectory picks the output directory: -output wins over the first
+// positional argument, which is kept for compatibility.
+func outputDirectory(output string, args []string) string {
+	switch {
+	case output != "":
+		return output
+	case len(args) > 0:
+		return args[0]
 	}
-	wg.Wait()
+	return defaultOutputDir
 }
 
-// downloadFile retrieves content from the given URL and writes it to dest.
-func downloadFile(url, dest string) error {
-	resp, err := http.Get(url)
+// parseMode parses the octal permissions given to the flag name. They must
+// grant the owner at least need, which the run relies on.
+func parseMode(name, s string, need os.FileMode) os.FileMode {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		fatalf("Invalid %s %q: must be octal permissions like %04o", name, s, need)
+	}
+	mode := os.FileMode(n)
+	if mode&need != need {
+		fatalf("Invalid %s %q: the owner needs at least %04o", name, s, need)
+	}
+	return mode
+}
+
+// exitOnError ends the program with exitFailed when only some episodes
+// failed, and exitFatal otherwise.
+func exitOnError(err error) {
+	if errors.Is(err, mfp.ErrEpisodesFailed) {
+		log.Printf("Error: %v", err)
+		os.Exit(exitFailed)
+	}
+	fatalf("Error: %v", err)
+}
+
+// export calls write with the file at path, or with stdout if path is "-".
+func export(path string, write func(w io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	out, err := os.Create(dest)
+// cleanOrphans lists the orphaned files and deletes them if force is set or
+// the user confirms.
+func cleanOrphans(ctx context.Context, d *mfp.Downloader, force bool) error {
+	orphans, err := d.Orphans(ctx)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned files.")
+		return nil
+	}
+	for _, rel := range orphans {
+		fmt.Println(rel)
+	}
+	if !force {
+		fmt.Printf("Delete these %d files? [y/N] ", len(orphans))
+		in := bufio.NewScanner(os.Stdin)
+		if !in.Scan() {
+			fmt.Println()
+			return in.Err()
+		}
+		if answer := strings.ToLower(strings.TrimSpace(in.Text())); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+	return d.RemoveOrphans(orphans)
 }
 
-// metadataComplete checks that the MP3 file has the expected album metadata and attached cover.
-func metadataComplete(mp3Path string) (bool, error) {
-	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+// hookTimeout bounds how long an -on-complete command may run.
+const hookTimeout = 5 * time.Minute
+
+// runHook runs command through the shell for a downloaded episode, with the
+// episode in the environment and the path as the first argument.
+func runHook(ctx context.Context, command string, ep mfp.Episode, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return false, err
+		return err
 	}
-	defer tag.Close()
-
-	if tag.Album() != "Music For Programming" {
-		return false, nil
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command, "sh", abs)
 	}
-	frames := tag.GetFrames("APIC")
-	if len(frames) == 0 {
-		return false, nil
+	cmd.Env = append(os.Environ(),
+		"EPISODE_NUMBER="+ep.Number,
+		"EPISODE_TITLE="+ep.Title,
+		"EPISODE_PATH="+abs,
+	)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", hookTimeout)
+		}
+		return err
 	}
-	return true, nil
+	return nil
 }
 
-// tagEpisode applies metadata and the cover image to the MP3 file.
-func tagEpisode(mp3Path, coverPath string) error {
-	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+// printList prints the episodes with their size and local status as an
+// aligned table on stdout, with titles cut to fit the terminal.
+func printList(ctx context.Context, d *mfp.Downloader) error {
+	episodes, err := d.List(ctx)
 	if err != nil {
 		return err
 	}
-	defer tag.Close()
+	// Number, size and status take up to about 30 columns.
+	titleWidth := max(terminalWidth()-30, 10)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tTITLE\tSIZE\tSTATUS")
+	for _, ep := range episodes {
+		size := "?"
+		if ep.ExpectedSize > 0 {
+			size = fmt.Sprintf("%.1f MB", float64(ep.ExpectedSize)/(1<<20))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ep.Number, truncate(ep.Title, titleWidth), size, ep.Status)
+	}
+	return w.Flush()
+}
 
-	tag.SetAlbum("Music For Programming")
+// truncate shortens s to at most n characters, ending it with "..." if it
+// was cut.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
 
-	cover, err := os.ReadFile(coverPath)
-	if err != nil {
-		return err
+// promptSelection lists the episodes on stdout and asks which ones to
+// download until the answer is a valid selection.
+func promptSelection(episodes []mfp.Episode) ([]mfp.Episode, error) {
+	for _, ep := range episodes {
+		size := "unknown size"
+		if ep.ExpectedSize > 0 {
+			size = fmt.Sprintf("%.1f MB", float64(ep.ExpectedSize)/(1<<20))
+		}
+		fmt.Printf("%5s  %s (%s)\n", ep.Number, ep.Title, size)
 	}
-	pic := id3v2.PictureFrame{
-		Encoding:    id3v2.EncodingUTF8,
-		MimeType:    "image/jpeg",
-		PictureType: id3v2.PTFrontCover,
-		Description: "Cover",
-		Picture:     cover,
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("Episodes to download (e.g. 1-5,10,12-14 or all): ")
+		if !in.Scan() {
+			if err := in.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("no episodes selected")
+		}
+		picked, err := mfp.ParseSelection(in.Text(), episodes)
+		if err == nil {
+			return picked, nil
+		}
+		fmt.Printf("Invalid selection: %v\n", err)
 	}
-	tag.AddAttachedPicture(pic)
-	return tag.Save()
 }
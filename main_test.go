@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestOutputDirectory(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		args   []string
+		want   string
+	}{
+		{"default", "", nil, defaultOutputDir},
+		{"positional", "", []string{"music"}, "music"},
+		{"flag", "music", nil, "music"},
+		{"flag wins over positional", "flag-dir", []string{"positional-dir"}, "flag-dir"},
+		{"extra positionals ignored", "", []string{"first", "second"}, "first"},
+	}
+	for _, tt := range tests {
+		if got := outputDirectory(tt.output, tt.args); got != tt.want {
+			t.Errorf("%s: outputDirectory(%q, %q) = %q, want %q", tt.name, tt.output, tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mfp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bogem/id3v2"
+	"github.com/mmcdole/gofeed"
+)
+
+// Artwork is an image embedded in every episode besides the front cover,
+// e.g. a back cover.
+type Artwork struct {
+	Source      string // URL or local file path of a JPEG or PNG image.
+	PictureType byte   // ID3v2 picture type, e.g. id3v2.PTBackCover.
+	// Description tells the images of an episode apart, so it must be
+	// unique. "Cover" is taken by the front cover.
+	Description string
+}
+
+// fetchArtwork loads every image in d.Artwork, checking that each one is a
+// supported type. Unlike the front cover, the images aren't saved to the
+// output directory.
+func (d *Downloader) fetchArtwork(ctx context.Context) error {
+	d.artwork = d.artwork[:0]
+	seen := map[string]bool{"Cover": true}
+	for _, art := range d.Artwork {
+		if seen[art.Description] {
+			return fmt.Errorf("artwork description %q is already taken by another image", art.Description)
+		}
+		seen[art.Description] = true
+		image, err := d.readImage(ctx, art.Source)
+		if err != nil {
+			return fmt.Errorf("failed to read artwork %q: %w", art.Description, err)
+		}
+		mimeType := http.DetectContentType(image)
+		if _, ok := coverFiles[mimeType]; !ok {
+			return fmt.Errorf("unsupported image type %s for artwork %q from %s", mimeType, art.Description, redactURL(art.Source))
+		}
+		d.artwork = append(d.artwork, id3v2.PictureFrame{
+			Encoding:    id3v2.EncodingUTF8,
+			MimeType:    mimeType,
+			PictureType: art.PictureType,
+			Description: art.Description,
+			Picture:     image,
+		})
+	}
+	return nil
+}
+
+// readImage reads the image at src, a URL or a local file path.
+func (d *Downloader) readImage(ctx context.Context, src string) ([]byte, error) {
+	if path, ok := localImagePath(src); ok {
+		return os.ReadFile(path)
+	}
+	return d.downloadImage(ctx, src)
+}
+
+// hasFrontCover reports whether the tag has a front cover picture.
+func hasFrontCover(tag *id3v2.Tag) bool {
+	return frontCover(tag) != nil
+}
+
+// frontCover returns the tag's front cover picture, or nil.
+func frontCover(tag *id3v2.Tag) []byte {
+	for _, f := range tag.GetFrames("APIC") {
+		if pic, ok := f.(id3v2.PictureFrame); ok && pic.PictureType == id3v2.PTFrontCover {
+			return pic.Picture
+		}
+	}
+	return nil
+}
+
+// coverCurrent reports whether the episode's embedded front cover is the
+// saved cover image, for d.CheckCover. Episodes with their own artwork
+// under d.PerEpisodeArt aren't compared.
+func (d *Downloader) coverCurrent(tag *id3v2.Tag, ep Episode) bool {
+	if d.coverSum == nil || (d.PerEpisodeArt && ep.ImageURL != "") {
+		return true
+	}
+	sum := sha256.Sum256(frontCover(tag))
+	return bytes.Equal(sum[:], d.coverSum)
+}
+
+// artDir is the directory of OutputDir where per-episode artwork is cached.
+const artDir = ".art"
+
+// itemImage returns the artwork URL of a feed item, preferring its
+// itunes:image, or "" if it has none.
+func itemImage(item *gofeed.Item) string {
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	if item.Image != nil {
+		return item.Image.URL
+	}
+	return ""
+}
+
+// episodeCover returns the cover to embed in the episode: with
+// d.PerEpisodeArt, its own artwork if the feed has one, downloaded once and
+// cached in artDir; otherwise, or if the artwork can't be fetched,
+// coverPath.
+func (d *Downloader) episodeCover(ctx context.Context, ep Episode, coverPath string) string {
+	if d.NoCover || !d.PerEpisodeArt || ep.ImageURL == "" {
+		return coverPath
+	}
+	path, err := d.cachedArt(ctx, ep.ImageURL)
+	if err != nil {
+		d.episodeLogger(ep).Warn("Error fetching episode artwork, using the cover", "url", redactURL(ep.ImageURL), "err", err)
+		return coverPath
+	}
+	return path
+}
+
+// cachedArt returns the cached copy of the image at rawURL, downloading it
+// first if needed. Episodes sharing an image share the file.
+func (d *Downloader) cachedArt(ctx context.Context, rawURL string) (string, error) {
+	d.artMu.Lock()
+	defer d.artMu.Unlock()
+	key := sha256.Sum256([]byte(rawURL))
+	base := filepath.Join(d.OutputDir, artDir, hex.EncodeToString(key[:8]))
+	for _, name := range coverFiles {
+		if path := base + filepath.Ext(name); validCover(path) {
+			return path, nil
+		}
+	}
+
+	image, err := d.readImage(ctx, rawURL)
+	if err != nil {
+		return "", err
+	}
+	name, ok := coverFiles[http.DetectContentType(image)]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type %s", http.DetectContentType(image))
+	}
+	path := base + filepath.Ext(name)
+	if err := os.MkdirAll(filepath.Dir(path), d.dirMode()); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+".tmp", image, d.fileMode()); err != nil {
+		return "", err
+	}
+	return path, os.Rename(path+".tmp", path)
+}
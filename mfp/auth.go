@@ -0,0 +1,41 @@
+package mfp
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// authorize adds the FeedAuth or BearerToken credentials to req if it goes to
+// the feed's host, so a private feed's enclosures and cover can be fetched
+// without handing the credentials to a third-party CDN.
+func (d *Downloader) authorize(req *http.Request) {
+	if d.FeedAuth == nil && d.BearerToken == "" {
+		return
+	}
+	feed, err := url.Parse(d.FeedURL)
+	if err != nil || !sameOrigin(feed, req.URL) {
+		return
+	}
+	if d.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.BearerToken)
+		return
+	}
+	password, _ := d.FeedAuth.Password()
+	req.SetBasicAuth(d.FeedAuth.Username(), password)
+}
+
+// sameOrigin reports whether a and b have the same scheme and host, so
+// credentials for one are safe to send to the other.
+func sameOrigin(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host
+}
+
+// redactURL returns rawURL with any password replaced by "xxxxx", for logs
+// and error messages.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,265 @@
+package mfp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2"
+	"github.com/mmcdole/gofeed"
+)
+
+// Chapter marks where a section of an episode starts. The JSON form matches
+// the Podcasting 2.0 JSON chapters format, which sidecar files use too.
+type Chapter struct {
+	StartTime float64 `json:"startTime"` // Seconds from the start of the episode.
+	Title     string  `json:"title"`
+}
+
+// chaptersFile is the Podcasting 2.0 JSON chapters document.
+type chaptersFile struct {
+	Chapters []Chapter `json:"chapters"`
+}
+
+// feedChapters reads Podlove Simple Chapters (<psc:chapters>) from an item.
+func feedChapters(item *gofeed.Item) []Chapter {
+	var chapters []Chapter
+	for _, list := range item.Extensions["psc"]["chapters"] {
+		for _, c := range list.Children["chapter"] {
+			start, ok := parseClock(c.Attrs["start"])
+			if !ok {
+				continue
+			}
+			chapters = append(chapters, Chapter{StartTime: start, Title: c.Attrs["title"]})
+		}
+	}
+	return chapters
+}
+
+// feedChaptersURL returns the URL of an item's <podcast:chapters> document.
+func feedChaptersURL(item *gofeed.Item) string {
+	for _, c := range item.Extensions["podcast"]["chapters"] {
+		if c.Attrs["url"] != "" {
+			return c.Attrs["url"]
+		}
+	}
+	return ""
+}
+
+// itemDuration returns the item's itunes:duration, or 0.
+func itemDuration(item *gofeed.Item) time.Duration {
+	if item.ITunesExt == nil {
+		return 0
+	}
+	s, _ := parseClock(item.ITunesExt.Duration)
+	return seconds(s)
+}
+
+// seconds converts s seconds to a Duration, or 0 if it doesn't fit one.
+func seconds(s float64) time.Duration {
+	d := s * float64(time.Second)
+	if d < 0 || d >= math.MaxInt64 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// parseClock parses a time such as "01:02:33.500", "02:33" or "153" into
+// seconds.
+func parseClock(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		// ParseFloat also takes "NaN" and "Inf", which aren't durations.
+		if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, true
+}
+
+// episodeChapters returns the chapters for the episode stored at path: those
+// listed in the feed, else those from the feed's chapters URL, else those in
+// a "<name>.chapters.json" file next to the episode. Sources that fail are
+// logged and skipped.
+func (d *Downloader) episodeChapters(ctx context.Context, ep Episode, path string) []Chapter {
+	log := d.episodeLogger(ep)
+	chapters := ep.Chapters
+	if len(chapters) == 0 && ep.ChaptersURL != "" {
+		var err error
+		if chapters, err = d.fetchChapters(ctx, ep.ChaptersURL); err != nil {
+			log.Warn("Error fetching chapters", "url", redactURL(ep.ChaptersURL), "err", err)
+		}
+	}
+	if len(chapters) == 0 {
+		sidecar := strings.TrimSuffix(path, filepath.Ext(path)) + ".chapters.json"
+		data, err := os.ReadFile(sidecar)
+		switch {
+		case err == nil:
+			var f chaptersFile
+			if err := json.Unmarshal(data, &f); err != nil {
+				log.Warn("Error reading chapters", "file", sidecar, "err", err)
+			}
+			chapters = f.Chapters
+		case !errors.Is(err, os.ErrNotExist):
+			log.Warn("Error reading chapters", "file", sidecar, "err", err)
+		}
+	}
+	chapters = slices.Clone(chapters)
+	slices.SortStableFunc(chapters, func(a, b Chapter) int {
+		switch {
+		case a.StartTime < b.StartTime:
+			return -1
+		case a.StartTime > b.StartTime:
+			return 1
+		}
+		return 0
+	})
+	return chapters
+}
+
+// fetchChapters downloads a JSON chapters document.
+func (d *Downloader) fetchChapters(ctx context.Context, url string) ([]Chapter, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var f chaptersFile
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return nil, err
+	}
+	return f.Chapters, nil
+}
+
+// maxChapters is the most entries a CTOC frame can list.
+const maxChapters = 255
+
+// addChapterFrames replaces the tag's chapters with CHAP frames for the
+// episode's chapters and a CTOC frame listing them in order. Each chapter
+// ends where the next begins; the last ends with the episode, or at its own
+// start if the duration is unknown.
+func addChapterFrames(tag *id3v2.Tag, ep Episode) {
+	tag.DeleteFrames("CHAP")
+	tag.DeleteFrames("CTOC")
+	chapters := ep.Chapters
+	if len(chapters) > maxChapters {
+		chapters = chapters[:maxChapters]
+	}
+	ids := make([]string, len(chapters))
+	for i, c := range chapters {
+		end := max(ep.Duration.Seconds(), c.StartTime)
+		if i+1 < len(chapters) {
+			end = chapters[i+1].StartTime
+		}
+		ids[i] = "chp" + strconv.Itoa(i)
+		tag.AddFrame("CHAP", chapterFrame{
+			id:      ids[i],
+			start:   uint32(c.StartTime * 1000),
+			end:     uint32(end * 1000),
+			title:   c.Title,
+			version: tag.Version(),
+		})
+	}
+	tag.AddFrame("CTOC", tocFrame{children: ids})
+}
+
+// chapterFrame is an ID3v2 CHAP frame with a TIT2 sub-frame for the title,
+// which bogem/id3v2 doesn't provide.
+type chapterFrame struct {
+	id         string
+	start, end uint32 // Milliseconds.
+	title      string
+	version    byte // Tag version, which decides the sub-frame encoding.
+}
+
+func (f chapterFrame) UniqueIdentifier() string { return f.id }
+
+func (f chapterFrame) Size() int { return len(f.body()) }
+
+func (f chapterFrame) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.body())
+	return int64(n), err
+}
+
+func (f chapterFrame) body() []byte {
+	b := append([]byte(f.id), 0)
+	b = binary.BigEndian.AppendUint32(b, f.start)
+	b = binary.BigEndian.AppendUint32(b, f.end)
+	b = binary.BigEndian.AppendUint32(b, 0xFFFFFFFF) // No byte offsets.
+	b = binary.BigEndian.AppendUint32(b, 0xFFFFFFFF)
+	if f.title == "" {
+		return b
+	}
+
+	// ID3v2.4 allows UTF-8 text; ID3v2.3 gets Latin-1.
+	var text []byte
+	if f.version >= 4 {
+		text = append([]byte{3}, f.title...)
+	} else {
+		text = make([]byte, 1+len([]rune(f.title)))
+		putLatin1(text[1:], f.title)
+	}
+	b = append(b, "TIT2"...)
+	if f.version >= 4 {
+		b = append(b, synchsafe(len(text))...)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(text)))
+	}
+	b = append(b, 0, 0) // Flags.
+	return append(b, text...)
+}
+
+// synchsafe encodes n as a 4-byte ID3v2.4 synchsafe integer.
+func synchsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// tocFrame is a top-level, ordered ID3v2 CTOC frame listing the chapters.
+type tocFrame struct {
+	children []string
+}
+
+func (f tocFrame) UniqueIdentifier() string { return "toc" }
+
+func (f tocFrame) Size() int { return len(f.body()) }
+
+func (f tocFrame) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.body())
+	return int64(n), err
+}
+
+func (f tocFrame) body() []byte {
+	b := append([]byte("toc"), 0)
+	b = append(b, 0x03, byte(len(f.children))) // Top-level and ordered.
+	for _, id := range f.children {
+		b = append(b, id...)
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,33 @@
+package mfp
+
+import "testing"
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"1:02:33", 3753, true},
+		{"01:02:33.500", 3753.5, true},
+		{"02:33", 153, true},
+		{"62:33", 3753, true},
+		{"153", 153, true},
+		{" 3753.25 ", 3753.25, true},
+		{"", 0, false},
+		{"1:xx", 0, false},
+		{"-5", 0, false},
+		{"1::2", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"infinity", 0, false},
+		{"1:-Inf", 0, false},
+		{"1:NaN:00", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseClock(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseClock(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
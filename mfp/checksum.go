@@ -0,0 +1,177 @@
+package mfp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// checksumFileName lists the SHA-256 of every episode in the output
+// directory, in the format of sha256sum, so `sha256sum -c` works there too.
+const checksumFileName = "SHA256SUMS"
+
+// checksums is the parsed SHA256SUMS file, keyed by slash-separated path
+// relative to the output directory.
+type checksums struct {
+	mu   sync.Mutex
+	path string
+	mode os.FileMode // Permissions of a new SHA256SUMS file.
+	sums map[string]string
+}
+
+// loadChecksums reads the SHA256SUMS file from dir. A missing file yields an
+// empty set. The file is written with the given mode.
+func loadChecksums(dir string, mode os.FileMode) (*checksums, error) {
+	c := &checksums{
+		path: filepath.Join(dir, checksumFileName),
+		mode: mode,
+		sums: make(map[string]string),
+	}
+	f, err := os.Open(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "<hash>  <name>"; a '*' instead of the second space marks binary mode.
+		line := scanner.Text()
+		if len(line) < sha256.Size*2+2 {
+			continue
+		}
+		sum, name := line[:sha256.Size*2], line[sha256.Size*2+2:]
+		c.sums[name] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %w", err)
+	}
+	return c, nil
+}
+
+// set records the checksum of the file at rel and saves the list.
+func (c *checksums) set(rel string, sum []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sums[filepath.ToSlash(rel)] = hex.EncodeToString(sum)
+	return c.save()
+}
+
+// remove drops the checksum of the file at rel, if any, and saves the list.
+func (c *checksums) remove(rel string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sums[filepath.ToSlash(rel)]; !ok {
+		return nil
+	}
+	delete(c.sums, filepath.ToSlash(rel))
+	return c.save()
+}
+
+// save writes the list, sorted by name. The caller must hold c.mu.
+func (c *checksums) save() error {
+	names := make([]string, 0, len(c.sums))
+	for name := range c.sums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", c.sums[name], name)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), c.mode); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	return nil
+}
+
+// fileChecksum returns the SHA-256 of the file at path.
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// recordChecksum stores the checksum of the episode file at rel, relative to
+// OutputDir. A nil sum means the file changed after it was downloaded, so it
+// is hashed again.
+func (d *Downloader) recordChecksum(rel string, sum []byte) {
+	if d.sums == nil {
+		return
+	}
+	if sum == nil {
+		var err error
+		if sum, err = fileChecksum(filepath.Join(d.OutputDir, rel)); err != nil {
+			d.logger().Error("Error computing checksum", "file", rel, "err", err)
+			return
+		}
+	}
+	if err := d.sums.set(rel, sum); err != nil {
+		d.logger().Error("Error saving checksum", "file", rel, "err", err)
+	}
+}
+
+// VerifyChecksums re-reads every file listed in the SHA256SUMS file of the
+// output directory and reports those that are missing or don't match. It
+// neither contacts the server nor modifies any file.
+func (d *Downloader) VerifyChecksums(ctx context.Context) error {
+	c, err := loadChecksums(d.OutputDir, d.fileMode())
+	if err != nil {
+		return err
+	}
+	if len(c.sums) == 0 {
+		return fmt.Errorf("no checksums found in %s", c.path)
+	}
+
+	log := d.logger()
+	names := make([]string, 0, len(c.sums))
+	for name := range c.sums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	bad := 0
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sum, err := fileChecksum(filepath.Join(d.OutputDir, filepath.FromSlash(name)))
+		switch {
+		case err != nil:
+			log.Error("Error reading file", "file", name, "err", err)
+			bad++
+		case hex.EncodeToString(sum) != c.sums[name]:
+			log.Error("Checksum mismatch", "file", name)
+			bad++
+		default:
+			log.Debug("Checksum OK", "file", name)
+		}
+	}
+	log.Info("Checksum verification finished", "checked", len(names), "failed", bad)
+	if bad > 0 {
+		return fmt.Errorf("%w: %d of %d files failed verification", ErrEpisodesFailed, bad, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package mfp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Orphans lists the audio files in the output directory, and partial
+// downloads of them, that don't belong to any episode currently in the feed,
+// e.g. episodes the feed dropped or renamed. Paths are relative to OutputDir.
+// Every episode in the feed counts, whatever range or limit is set, and
+// other files such as the cover, playlist and state are never listed.
+func (d *Downloader) Orphans(ctx context.Context) ([]string, error) {
+	if err := d.loadEpisodes(ctx); err != nil {
+		return nil, err
+	}
+	expected := make(map[string]bool, len(d.feedEpisodes))
+	for _, ep := range d.feedEpisodes {
+		expected[d.episodePath(ep)] = true
+	}
+
+	var orphans []string
+	err := filepath.WalkDir(d.OutputDir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == d.OutputDir {
+			return filepath.SkipAll // Nothing downloaded yet.
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(rel, ".part")
+		if _, audio := FormatExtension(filepath.Ext(name)); !audio || expected[name] {
+			return nil
+		}
+		orphans = append(orphans, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan the output directory: %w", err)
+	}
+	slices.Sort(orphans)
+	return orphans, nil
+}
+
+// RemoveOrphans deletes the files returned by Orphans and drops their
+// checksums.
+func (d *Downloader) RemoveOrphans(orphans []string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sums, err := loadChecksums(d.OutputDir, d.fileMode())
+	if err != nil {
+		return err
+	}
+	log := d.logger()
+	for _, rel := range orphans {
+		if err := os.Remove(filepath.Join(d.OutputDir, rel)); err != nil {
+			return fmt.Errorf("failed to remove orphaned file: %w", err)
+		}
+		if err := sums.remove(rel); err != nil {
+			return err
+		}
+		log.Info("Removed orphaned file", "file", rel)
+	}
+	return nil
+}
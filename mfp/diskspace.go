@@ -0,0 +1,40 @@
+package mfp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// checkDiskSpace makes sure the output filesystem can hold every episode
+// the plan downloads. Episodes of unknown size are not counted. With d.Force
+// set, a shortfall is only logged.
+func (d *Downloader) checkDiskSpace(steps []planStep) error {
+	if d.Sink != nil {
+		return nil // Nothing is downloaded to OutputDir.
+	}
+	var required uint64
+	for _, step := range steps {
+		if step.action.downloads() && step.ep.ExpectedSize > 0 {
+			required += uint64(step.ep.ExpectedSize)
+		}
+	}
+	if required == 0 {
+		return nil
+	}
+
+	available, err := freeSpace(d.OutputDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check free disk space: %w", err)
+	}
+	if available >= required {
+		return nil
+	}
+	if d.Force {
+		d.logger().Warn("Not enough free disk space, continuing anyway", "required", required, "available", available)
+		return nil
+	}
+	return fmt.Errorf("not enough free disk space: %d bytes required, %d available (use -force to continue anyway)", required, available)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd && !netbsd && !solaris && !windows
+
+package mfp
+
+import "errors"
+
+// freeSpace is not supported on this platform.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
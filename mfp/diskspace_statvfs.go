@@ -0,0 +1,15 @@
+//go:build netbsd || solaris
+
+package mfp
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to an unprivileged user on the
+// filesystem holding dir.
+func freeSpace(dir string) (uint64, error) {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Frsize), nil
+}
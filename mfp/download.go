@@ -0,0 +1,894 @@
+package mfp
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEpisodesFailed is returned, wrapped with a count, when the run went
+// through but some episodes could not be downloaded, tagged or verified.
+var ErrEpisodesFailed = errors.New("some episodes failed")
+
+// downloadAndTagEpisodes plans what to do with every episode and then
+// carries out the plan concurrently. Episodes whose audio is intact but whose
+// metadata is incomplete are re-tagged without being downloaded again.
+// Downloading and tagging have separate limits, so an episode being tagged
+// doesn't hold up the next download.
+func (d *Downloader) downloadAndTagEpisodes(ctx context.Context) error {
+	steps, err := d.plan(ctx)
+	if err != nil {
+		return err
+	}
+	if d.DryRun {
+		d.listPlannedDownloads(steps)
+		return nil
+	}
+	if err := d.checkDiskSpace(steps); err != nil {
+		return err
+	}
+
+	// Progress bars only make sense when a person is watching.
+	d.logger() // Sets up d.logOut.
+	if f, ok := d.logOut.w.(*os.File); ok && isTerminal(f) && !d.JSONLogs && d.LogLevel <= slog.LevelInfo {
+		d.progress = newProgressRenderer(f)
+		d.logOut.swap(d.progress)
+		defer func() {
+			d.logOut.swap(f)
+			d.progress.Close()
+			d.progress = nil
+		}()
+	}
+
+	d.stats = &runStats{start: time.Now()}
+
+	var wg sync.WaitGroup
+	workers := d.workers()
+	downloads := make(slots, workers)
+	if d.TagConcurrency > 0 {
+		workers = d.TagConcurrency
+	}
+	d.tagSlots = make(slots, workers)
+	defer func() { d.tagSlots = nil }()
+	coverPath := d.coverPath()
+
+	// start runs the step in the background, once it has a download slot if
+	// it needs one. It reports false if ctx was cancelled first.
+	start := func(step planStep) bool {
+		// Take the download slot here so episodes start in plan order.
+		var release func()
+		if step.action.downloads() {
+			if !downloads.acquire(ctx) {
+				return false
+			}
+			release = sync.OnceFunc(downloads.release)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release != nil {
+				defer release()
+			}
+			d.execute(ctx, step, coverPath, release)
+		}()
+		return true
+	}
+
+	var queued int64 // Expected bytes of the downloads started so far.
+	capped := 0      // Downloads left out by d.MaxTotalSize.
+	for _, step := range steps {
+		if step.action.downloads() && d.MaxTotalSize > 0 {
+			// Once one episode doesn't fit, later ones wait too, so a run
+			// never skips ahead in the plan.
+			if capped > 0 || queued+step.ep.ExpectedSize > d.MaxTotalSize {
+				capped++
+				continue
+			}
+			queued += step.ep.ExpectedSize
+		}
+		if !start(step) {
+			break // Interrupted: don't start any more episodes.
+		}
+	}
+	if capped > 0 {
+		d.logger().Warn("Download size cap reached, leaving episodes for a later run",
+			"max_total_size", formatSize(d.MaxTotalSize), "queued", formatSize(queued), "left", capped)
+	}
+	wg.Wait()
+
+	// Give the episodes that failed one more go once the others are done,
+	// e.g. after a connection hiccup.
+	if d.Retries > 0 && ctx.Err() == nil && d.stats.failed.Load() > 0 {
+		retry := d.stats.takeFailed()
+		d.logger().Info("Retrying failed episodes", "episodes", len(retry))
+		for _, step := range retry {
+			if !start(d.planEpisode(ctx, step.ep)) {
+				break
+			}
+		}
+		wg.Wait()
+		if still := d.stats.failedEpisodes(); len(still) > 0 {
+			d.logger().Error("Episodes failed again", "episodes", still)
+		}
+	}
+	d.logSummary(d.stats)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed := d.stats.failed.Load(); failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrEpisodesFailed, failed, len(steps))
+	}
+	return nil
+}
+
+// execute carries out the planned action for one episode. Failures are
+// logged and counted rather than returned, so one bad episode doesn't stop
+// the others. For a download, releaseDownload gives up the download slot
+// once the audio is on disk; tagging waits for a slot in d.tagSlots.
+func (d *Downloader) execute(ctx context.Context, step planStep, coverPath string, releaseDownload func()) {
+	ep, fileName, targetPath := step.ep, step.fileName, step.path
+	log := d.episodeLogger(ep)
+	fail := func(msg string, err error) {
+		log.Error(msg, "file", fileName, "err", err)
+		d.stats.fail(step)
+		d.emit(ctx, ProgressEvent{Episode: ep.Number, Phase: PhaseError, Err: err})
+	}
+	done := func() {
+		d.emit(ctx, ProgressEvent{Episode: ep.Number, Phase: PhaseComplete})
+	}
+
+	switch step.action {
+	case actionSkip:
+		log.Debug("Episode already complete", "file", fileName)
+		if d.Sink == nil {
+			d.markComplete(ep, targetPath, 0, 0)
+		}
+		d.stats.complete.Add(1)
+		done()
+		return
+
+	case actionRetag:
+		log.Info("Metadata incomplete, updating it", "file", fileName)
+		if !canTag(ep) {
+			fail("Error updating metadata", untaggable(ep))
+			return
+		}
+		if !d.tagSlots.acquire(ctx) {
+			fail("Error updating metadata", ctx.Err())
+			return
+		}
+		defer d.tagSlots.release()
+		d.emit(ctx, ProgressEvent{Episode: ep.Number, Phase: PhaseTagging})
+		if d.Chapters {
+			ep.Chapters = d.episodeChapters(ctx, ep, targetPath)
+		}
+		var modTime time.Time
+		if info, err := os.Stat(targetPath); err == nil {
+			modTime = info.ModTime()
+		}
+		if err := d.tagEpisode(targetPath, d.episodeCover(ctx, ep, coverPath), ep); err != nil {
+			fail("Error updating metadata", err)
+			return
+		}
+		log.Info("Metadata updated", "file", fileName)
+		d.setModTime(ep, targetPath, modTime) // Saving the tags reset it.
+		d.recordChecksum(fileName, nil)
+		d.markComplete(ep, targetPath, 0, 0)
+		d.stats.retagged.Add(1)
+		done()
+		return
+
+	case actionRedownload:
+		log.Warn("Unexpected file size, downloading it again", "file", fileName)
+		if err := os.Remove(targetPath); err != nil {
+			fail("Error removing file", err)
+			return
+		}
+	}
+
+	// Download, or resume, tagging on the way.
+	if !canTag(ep) {
+		if d.StrictTags {
+			fail("Error tagging episode", untaggable(ep))
+			return
+		}
+		log.Warn("Tagging isn't supported for this format, leaving it untagged", "file", fileName, "ext", ep.Ext)
+	} else if d.Chapters {
+		ep.Chapters = d.episodeChapters(ctx, ep, targetPath)
+	}
+	cover := d.episodeCover(ctx, ep, coverPath)
+	log.Info("Downloading episode", "file", fileName)
+	d.Metrics.downloadStarted()
+	started := time.Now()
+	got, err := d.downloadFile(ctx, ep, fileName, cover, d.sink())
+	d.Metrics.downloadFinished(err == nil, time.Since(started))
+	releaseDownload()
+	if err != nil {
+		fail("Error downloading episode", err)
+		return
+	}
+
+	if d.Sink != nil {
+		// Stored elsewhere, so there is no file here to look after.
+		log.Info("Episode stored", "file", fileName)
+		if err := d.state.markStored(ep, targetPath); err != nil {
+			log.Error("Error saving state", "err", err)
+		}
+		d.stats.downloaded.Add(1)
+		done()
+		d.runHook(ctx, ep, fileName)
+		return
+	}
+
+	sum := got.sum
+	if canTag(ep) && d.needsTagging(targetPath, ep) {
+		// A partial file left by an older version holds the enclosure as
+		// downloaded, its tags included.
+		if !d.tagSlots.acquire(ctx) {
+			fail("Error tagging episode", ctx.Err())
+			return
+		}
+		d.emit(ctx, ProgressEvent{Episode: ep.Number, Phase: PhaseTagging})
+		err := d.tagEpisode(targetPath, cover, ep)
+		d.tagSlots.release()
+		if err != nil {
+			fail("Error tagging episode", err)
+			return
+		}
+		sum = nil // Tagging rewrote the file.
+	}
+	modTime := got.modTime
+	if modTime.IsZero() && ep.Published != nil {
+		modTime = *ep.Published
+	}
+	d.setModTime(ep, targetPath, modTime)
+	d.recordChecksum(fileName, sum)
+	audio, _ := audioSize(targetPath)
+	log.Info("Episode processed", "file", fileName)
+	d.markComplete(ep, targetPath, got.size, audio)
+	d.stats.downloaded.Add(1)
+	done()
+	d.runHook(ctx, ep, targetPath)
+}
+
+// runHook calls d.OnComplete for a freshly downloaded episode. A failing
+// hook is logged but doesn't count against the episode.
+func (d *Downloader) runHook(ctx context.Context, ep Episode, path string) {
+	if d.OnComplete == nil {
+		return
+	}
+	log := d.episodeLogger(ep)
+	started := time.Now()
+	if err := d.OnComplete(ctx, ep, path); err != nil {
+		log.Warn("Completion hook failed", "file", path, "err", err)
+		return
+	}
+	log.Info("Completion hook finished", "file", path, "elapsed", time.Since(started).Round(time.Millisecond))
+}
+
+// maxAutoWorkers caps the automatic worker count. Downloads are bound by the
+// network rather than the CPU, and more parallel connections than this rarely
+// speed things up while putting more load on the server.
+const maxAutoWorkers = 4
+
+// workers returns how many episodes to process at once: d.Concurrency, or
+// when it is 0, one per episode up to maxAutoWorkers.
+func (d *Downloader) workers() int {
+	if d.Concurrency > 0 {
+		return d.Concurrency
+	}
+	n := max(1, min(len(d.Episodes), maxAutoWorkers))
+	d.logger().Debug("Picked worker count", "workers", n)
+	return n
+}
+
+// slots limits how many goroutines do something at once.
+type slots chan struct{}
+
+// acquire waits for a free slot and reports whether it got one before ctx
+// was cancelled.
+func (s slots) acquire(ctx context.Context) bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func (s slots) release() {
+	<-s
+}
+
+// listPlannedDownloads writes what a real run would do with the episodes
+// that aren't complete yet, plus totals, to d.DryRunOutput without touching
+// the output directory.
+func (d *Downloader) listPlannedDownloads(steps []planStep) {
+	w := d.DryRunOutput
+	if w == nil {
+		w = os.Stdout
+	}
+	pending, done := 0, 0
+	for _, step := range steps {
+		if step.action == actionSkip {
+			done++
+			continue
+		}
+		pending++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d bytes\n", step.action, step.fileName, redactURL(step.ep.URL), step.ep.ExpectedSize)
+	}
+	fmt.Fprintf(w, "%d episodes would be downloaded or updated, %d already complete.\n", pending, done)
+}
+
+// download is what downloadFile reports about a finished download.
+type download struct {
+	sum     []byte    // SHA-256 of the stored file, nil if not known.
+	size    int64     // Bytes of the enclosure, its own tags included.
+	modTime time.Time // Last-Modified from the server, zero if it sent none.
+}
+
+// downloadFile streams the episode into sink under name: for an MP3, the
+// tags built for it with the cover at coverPath, then the enclosure with
+// its own tags dropped, which also checks that it is MP3 audio. A transfer
+// cut off partway is tried again, up to d.Retries times. With a FileSink,
+// the attempt resumes from what was written so far, as it does from a
+// ".part" file a previous run left; any other sink starts over.
+func (d *Downloader) downloadFile(ctx context.Context, ep Episode, name, coverPath string, sink Sink) (got download, err error) {
+	log := d.episodeLogger(ep)
+	var tag, v1 []byte
+	if canTag(ep) {
+		if tag, err = d.encodeTag(coverPath, ep); err != nil {
+			return download{}, fmt.Errorf("failed to build tags: %w", err)
+		}
+		if d.ID3v1 {
+			v1 = id3v1Tag(d.album(), ep)
+		}
+	}
+	files, isFile := sink.(FileSink)
+	if isFile {
+		defer func() {
+			if err != nil {
+				files.discard(name)
+			}
+		}()
+	}
+
+	err = d.transfer(ctx, ep, name, func(ctx context.Context) (bool, error) {
+		var out io.WriteCloser
+		var offset, written int64
+		if isFile && ep.ExpectedSize > 0 {
+			part, err := files.resume(name)
+			if err != nil {
+				return false, err
+			}
+			if part != nil {
+				out = part
+				offset, written, err = d.resumeOffset(ctx, ep, part)
+				if err != nil || offset <= 0 || offset >= ep.ExpectedSize {
+					// Nothing worth keeping: start over.
+					part.Abort()
+					out, offset = nil, 0
+				} else {
+					log.Info("Resuming download", "file", filepath.Base(name), "offset", offset)
+				}
+			}
+		}
+
+		// Hash while writing so the file doesn't have to be read again,
+		// unless it resumes from bytes written before.
+		var h hash.Hash
+		var audio *audioWriter
+		open := func(resumed bool) (io.Writer, error) {
+			var w io.Writer = out
+			if !resumed {
+				if out != nil {
+					out.(Aborter).Abort() // Range ignored: download it all again.
+				}
+				var err error
+				if out, err = sink.Create(ctx, ep, name); err != nil {
+					return nil, fmt.Errorf("failed to create %s: %w", name, err)
+				}
+				h = sha256.New()
+				w = io.MultiWriter(out, h)
+				if _, err := w.Write(tag); err != nil {
+					return nil, err
+				}
+			}
+			if !canTag(ep) {
+				return w, nil
+			}
+			audio = &audioWriter{w: w, skip: -1, trimV1: v1 != nil}
+			if resumed {
+				audio.skip, audio.n = 0, written
+			}
+			return audio, nil
+		}
+		size, modTime, resumable, err := d.downloadPart(ctx, ep, offset, open)
+		if err == nil && audio != nil {
+			err = audio.finish(v1)
+		}
+		if err != nil {
+			if part, ok := out.(*sinkFile); ok && resumable {
+				part.keep()
+			} else if a, ok := out.(Aborter); ok {
+				a.Abort()
+			} else if out != nil {
+				out.Close()
+			}
+			// Downloading the same bytes again won't make them audio.
+			return resumable && !errors.Is(err, errNotMP3), err
+		}
+		if err := out.Close(); err != nil {
+			return false, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		got = download{size: size, modTime: modTime}
+		if h != nil {
+			got.sum = h.Sum(nil)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return download{}, err
+	}
+	return got, nil
+}
+
+// resumeOffset works out where in the enclosure a download resumes from the
+// partial file: its tag, then written bytes of audio. For an MP3 the
+// enclosure's own ID3v2 tag was dropped, so its size is read from the
+// enclosure's first bytes. A partial file without a tag holds the enclosure
+// as it was downloaded.
+func (d *Downloader) resumeOffset(ctx context.Context, ep Episode, part *sinkFile) (offset, written int64, err error) {
+	info, err := part.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !canTag(ep) {
+		return info.Size(), 0, nil
+	}
+	header := make([]byte, 10)
+	if _, err := part.ReadAt(header, 0); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	tagSize := tagSizeFromHeader(header)
+	if tagSize == 0 {
+		return info.Size(), info.Size(), nil
+	}
+	written = info.Size() - tagSize
+	if written <= 0 {
+		return 0, 0, nil
+	}
+	enclosureTag, err := d.enclosureTagSize(ctx, ep)
+	if err != nil {
+		return 0, 0, err
+	}
+	return enclosureTag + written, written, nil
+}
+
+// enclosureTagSize returns the size of the ID3v2 tag at the start of the
+// episode's enclosure, asking the server for its first bytes only.
+func (d *Downloader) enclosureTagSize(ctx context.Context, ep Episode) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-9")
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status %s from %s", resp.Status, redactURL(ep.URL))
+	}
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(resp.Body, header); err != nil {
+		return 0, err
+	}
+	return tagSizeFromHeader(header), nil
+}
+
+// transfer calls attempt until the episode is through. An attempt that
+// reports the transfer as resumable is tried again, up to d.Retries times,
+// and the whole transfer gives up after d.DownloadTimeout however many
+// attempts it took. name is the episode's file, for logging.
+func (d *Downloader) transfer(ctx context.Context, ep Episode, name string, attempt func(ctx context.Context) (resumable bool, err error)) error {
+	if d.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, d.DownloadTimeout,
+			fmt.Errorf("download took longer than %s", d.DownloadTimeout))
+		defer cancel()
+	}
+
+	delay := time.Second
+	for n := 1; ; n++ {
+		resumable, err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		if !resumable || n > d.Retries || ctx.Err() != nil {
+			return err
+		}
+		wait := d.jitter(delay)
+		d.episodeLogger(ep).Warn("Download interrupted, retrying", "file", name, "err", err, "attempt", n, "retries", d.Retries, "delay", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return stallCause(ctx, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// downloadPart requests the episode from offset on, or in full when offset
+// is zero or the server ignores the range, and copies it to the writer open
+// returns. open is told whether the server sent only the rest, in which case
+// the writer goes on after the first offset bytes. resumable is set when the
+// transfer started but was cut off, so the bytes written so far are worth
+// keeping for another attempt. size is the length of the whole enclosure.
+func (d *Downloader) downloadPart(ctx context.Context, ep Episode, offset int64, open func(resumed bool) (io.Writer, error)) (size int64, modTime time.Time, resumable bool, err error) {
+	expectedSize := ep.ExpectedSize
+
+	// Give up on an attempt that stops receiving data for d.Timeout.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var stall *time.Timer
+	if d.Timeout > 0 {
+		stall = time.AfterFunc(d.Timeout, func() {
+			cancel(fmt.Errorf("no data received for %s", d.Timeout))
+		})
+		defer stall.Stop()
+		ctx = withAttemptTimeout(ctx, stall, d.Timeout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.URL, nil)
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return 0, time.Time{}, false, stallCause(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	// Don't save an error page as audio.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, time.Time{}, false, fmt.Errorf("unexpected status %s from %s", resp.Status, redactURL(ep.URL))
+	}
+	if final := resp.Request.URL.String(); final != ep.URL {
+		d.episodeLogger(ep).Debug("Enclosure redirected", "url", resp.Request.URL.Redacted())
+		// A redirect to a login or landing page is a common CDN failure.
+		if ct := resp.Header.Get("Content-Type"); !isAudioContentType(ct) {
+			return 0, time.Time{}, false, fmt.Errorf("redirected to %s serving %q, not audio", resp.Request.URL.Redacted(), ct)
+		}
+	}
+	if ct := resp.Header.Get("Content-Type"); d.CheckContentType && !genericType(mediaType(ct)) && !d.allowedType(mediaType(ct)) {
+		return 0, time.Time{}, false, fmt.Errorf("%w: %s serves %q", ErrTypeNotAllowed, redactURL(ep.URL), ct)
+	}
+
+	resumed := offset > 0 && resp.StatusCode == http.StatusPartialContent
+	if !resumed {
+		offset = 0
+	}
+	out, err := open(resumed)
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+
+	var body io.Reader = resp.Body
+	if d.limiter != nil {
+		body = &throttledReader{ctx: ctx, r: body, limiter: d.limiter}
+	}
+	if stall != nil {
+		body = &idleTimeoutReader{r: body, timer: stall, timeout: d.Timeout}
+	}
+	if log := d.episodeLogger(ep); log.Enabled(ctx, LevelTrace) {
+		body = &traceReader{ctx: ctx, r: body, log: log, read: offset, total: expectedSize, next: offset + traceChunk}
+	}
+	if d.Progress != nil {
+		ev := ProgressEvent{Episode: ep.Number, Phase: PhaseDownloading, Bytes: offset, Total: expectedSize}
+		if ev.Total <= 0 && resp.ContentLength > 0 {
+			ev.Total = offset + resp.ContentLength
+		}
+		d.emit(ctx, ev)
+		body = &progressReader{ctx: ctx, r: body, d: d, ev: ev, last: time.Now()}
+	}
+	if d.progress != nil {
+		total := expectedSize
+		if total <= 0 && resp.ContentLength > 0 {
+			total = offset + resp.ContentLength
+		}
+		bar := d.progress.add("Episode "+ep.Number, offset, total)
+		defer d.progress.remove(bar)
+		body = bar.proxyReader(body)
+	}
+
+	n, err := io.Copy(out, body)
+	if d.stats != nil {
+		d.stats.bytes.Add(n)
+	}
+	d.Metrics.addBytes(n)
+	if err != nil {
+		return 0, time.Time{}, true, stallCause(ctx, err)
+	}
+	if expectedSize > 0 && offset+n != expectedSize {
+		// A connection closed early looks like a clean end of the body.
+		return 0, time.Time{}, offset+n < expectedSize,
+			fmt.Errorf("downloaded %d bytes, expected %d", offset+n, expectedSize)
+	}
+	modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return offset + n, modTime, false, nil
+}
+
+// traceChunk is how often traceReader logs, in bytes.
+const traceChunk = 1 << 20
+
+// traceReader logs at LevelTrace every time another traceChunk bytes of an
+// episode have been read.
+type traceReader struct {
+	ctx         context.Context
+	r           io.Reader
+	log         *slog.Logger
+	read, total int64
+	next        int64 // Byte count at which to log next.
+}
+
+func (t *traceReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	if t.read >= t.next || err == io.EOF {
+		t.log.Log(t.ctx, LevelTrace, "Received chunk", "bytes", t.read, "total", t.total)
+		t.next = t.read + traceChunk
+	}
+	return n, err
+}
+
+// setModTime sets the modification time of the episode file to t, so file
+// browsers sort episodes by their release. A zero t leaves it alone.
+func (d *Downloader) setModTime(ep Episode, path string, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if err := os.Chtimes(path, t, t); err != nil {
+		d.episodeLogger(ep).Warn("Error setting file time", "err", err)
+	}
+}
+
+// markComplete records the episode in the state file, logging any failure
+// since the episode itself is fine.
+func (d *Downloader) markComplete(ep Episode, path string, downloaded, audio int64) {
+	if err := d.state.markComplete(ep, path, downloaded, audio); err != nil {
+		d.episodeLogger(ep).Error("Error saving state", "err", err)
+	}
+}
+
+// isAudioContentType reports whether a response Content-Type can hold audio.
+// Generic binary types are accepted since many CDNs don't label files.
+func isAudioContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct == ""
+	}
+	return strings.HasPrefix(mediaType, "audio/") ||
+		mediaType == "application/octet-stream" ||
+		mediaType == "binary/octet-stream" ||
+		mediaType == "video/mp4" // Some hosts label .m4a this way.
+}
+
+// idleTimeoutReader pushes back timer every time data arrives, so it only
+// fires once the body has been idle for timeout.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// stallCause replaces err with the reason ctx was cancelled when a download
+// was aborted for being idle, which is more helpful than "context canceled".
+func stallCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return cause
+	}
+	return err
+}
+
+// getWithRetry sends req, retrying transient connection errors, 5xx and 429
+// responses up to d.Retries times with exponential backoff starting at one
+// second, with jitter, or after the wait the server's Retry-After header asks
+// for. Other responses, including other 4xx, and errors a retry can't fix
+// are returned to the caller as-is, and so is the last one when the wait
+// would outlast the request's deadline. Each attempt gets the full timeouts
+// set with withAttemptTimeout.
+func (d *Downloader) getWithRetry(req *http.Request) (*http.Response, error) {
+	if d.UserAgent != "" {
+		req.Header.Set("User-Agent", d.UserAgent)
+	}
+	d.authorize(req)
+	ctx := req.Context()
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		resp, err := d.Client.Do(req)
+		if err == nil && !retryable(resp) {
+			return resp, nil
+		}
+		if err != nil {
+			err = stallCause(ctx, err)
+		}
+		if attempt > d.Retries || permanent(err) {
+			return resp, err
+		}
+		wait := d.jitter(delay)
+		if err == nil {
+			after, ok := retryAfter(resp, time.Now())
+			if ok {
+				wait = after
+			}
+			if ok && after > maxRetryAfter || !fitsDeadline(ctx, wait) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			err = fmt.Errorf("server returned %s", resp.Status)
+		} else if !fitsDeadline(ctx, wait) {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, stallCause(ctx, ctx.Err())
+		}
+		d.logger().Warn("Request failed, retrying", "url", req.URL.Redacted(), "err", err, "attempt", attempt, "retries", d.Retries, "delay", wait.Round(time.Millisecond))
+		// The wait doesn't count against the timeouts of the attempts.
+		restart := pauseTimeouts(ctx)
+		select {
+		case <-time.After(wait):
+			restart()
+		case <-ctx.Done():
+			return nil, stallCause(ctx, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// sizeTolerancePercent is how far, as a percentage of the enclosure length,
+// a tagged file's audio may fall below it when the state file doesn't record
+// the download's audio size. The enclosure may ship with its own ID3 tag,
+// which tagEpisode replaces, so the audio alone is slightly smaller than the
+// original download.
+const sizeTolerancePercent = 1
+
+// fileIsComplete reports whether the episode at path has been fully
+// downloaded and tagged. Episodes recorded in the state file are trusted as
+// long as the file still has the recorded size.
+func (d *Downloader) fileIsComplete(ctx context.Context, ep Episode, path string) (bool, error) {
+	if d.state != nil && d.state.isComplete(ep, path) {
+		return true, nil
+	}
+	sizeOk, err := d.sizeMatches(ctx, ep, path)
+	if err != nil || !sizeOk {
+		return false, err
+	}
+	if !canTag(ep) {
+		// Nothing to tag, the audio is all there is, unless tags are a must.
+		return !d.StrictTags, nil
+	}
+	return d.metadataComplete(path, ep)
+}
+
+// sizeMatches compares the audio on disk, excluding ID3 tags, against the
+// audio size the state file recorded for the download, or else the
+// enclosure length. When the feed doesn't advertise a length it asks the
+// server with a HEAD request; if neither knows, the size is assumed correct.
+func (d *Downloader) sizeMatches(ctx context.Context, ep Episode, path string) (bool, error) {
+	audio, err := audioSize(path)
+	if err != nil {
+		return false, err
+	}
+	if d.state != nil {
+		if recorded := d.state.audio(ep, path); recorded > 0 {
+			return audio == recorded, nil
+		}
+	}
+	expected := ep.ExpectedSize
+	if expected <= 0 {
+		var err error
+		if expected, err = d.remoteSize(ctx, ep); err != nil || expected == 0 {
+			return err == nil, err
+		}
+	}
+	return audio <= expected && audio >= expected-expected*sizeTolerancePercent/100, nil
+}
+
+// audioSize returns the size of the file at path without its ID3v2 and
+// ID3v1 tags.
+func audioSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	tagSize, err := id3v2TagSize(path)
+	if err != nil {
+		return 0, err
+	}
+	v1Size, err := id3v1TagSize(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() - tagSize - v1Size, nil
+}
+
+// remoteSize asks the server for the enclosure's current size with a HEAD
+// request. It returns 0 if the server doesn't say.
+func (d *Downloader) remoteSize(ctx context.Context, ep Episode) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ep.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		return 0, nil
+	}
+	return resp.ContentLength, nil
+}
+
+// id3v2TagSize returns the number of bytes taken by the ID3v2 tag at the
+// start of the file, or 0 if there is none.
+func id3v2TagSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return tagSizeFromHeader(header), nil
+}
+
+// tagSizeFromHeader returns the size of the ID3v2 tag whose 10-byte header
+// starts header, or 0 if it isn't one.
+func tagSizeFromHeader(header []byte) int64 {
+	if string(header[:3]) != "ID3" {
+		return 0
+	}
+	// The tag size is a 28-bit synchsafe integer that excludes the header.
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+	size += 10
+	if header[5]&0x10 != 0 {
+		size += 10 // Footer present.
+	}
+	return size
+}
@@ -0,0 +1,624 @@
+// Package mfp downloads the Music For Programming podcast and tags every
+// episode with its album, title, track number and cover art.
+package mfp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/bogem/id3v2"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/sync/errgroup"
+)
+
+// Version is the release of this module, sent in the default User-Agent.
+const Version = "0.1.0"
+
+// Defaults for the Music For Programming feed.
+const (
+	DefaultFeedURL     = "https://musicforprogramming.net/rss.php"
+	DefaultCoverURL    = "https://musicforprogramming.net/img/folder.jpg"
+	DefaultConcurrency = 3
+	DefaultRetries     = 3
+	DefaultRetryJitter = 0.2
+	DefaultTimeout     = 30 * time.Second
+	DefaultUserAgent   = "go-musicforprogramming/" + Version
+	DefaultRedirects   = 5
+	DefaultAlbum       = "Music For Programming"
+	// DefaultMaxIdleConnsPerHost keeps a connection open for every download
+	// worker, so parallel downloads from one CDN don't redo the TCP and TLS
+	// handshakes. net/http keeps only 2 by default.
+	DefaultMaxIdleConnsPerHost = 8
+	DefaultIdleConnTimeout     = 90 * time.Second
+	// DefaultDirMode and DefaultFileMode are the permissions of created
+	// directories and files, before the umask.
+	DefaultDirMode  os.FileMode = 0755
+	DefaultFileMode os.FileMode = 0644
+)
+
+// DefaultRequiredFrames are the ID3v2 frames a file must have to count as
+// fully tagged: the cover.
+var DefaultRequiredFrames = []string{"APIC"}
+
+// DefaultAllowedTypes are the enclosure MIME types downloaded by default:
+// any audio.
+var DefaultAllowedTypes = []string{"audio/*"}
+
+// Episode represents a podcast episode with a reformatted title.
+type Episode struct {
+	Number       string        `json:"number"`
+	Title        string        `json:"title"`
+	URL          string        `json:"url"`
+	Ext          string        `json:"ext"` // Audio file extension, e.g. ".mp3".
+	Artist       string        `json:"artist,omitempty"`
+	AlbumArtist  string        `json:"album_artist,omitempty"` // Same for every episode of the feed.
+	Description  string        `json:"description,omitempty"`  // Episode notes as plain text.
+	Published    *time.Time    `json:"published,omitempty"`    // Publication date from the feed, nil if unknown.
+	ExpectedSize int64         `json:"expected_size"`          // Enclosure length in bytes, 0 if unknown.
+	Duration     time.Duration `json:"-"`                      // Length from itunes:duration, 0 if unknown; "duration" in seconds in JSON.
+	Chapters     []Chapter     `json:"chapters,omitempty"`     // Chapters listed in the feed.
+	ChaptersURL  string        `json:"chapters_url,omitempty"` // JSON chapters document linked from the feed.
+	ImageURL     string        `json:"image_url,omitempty"`    // Episode artwork, e.g. from itunes:image.
+}
+
+// episodeJSON is Episode as encoded in JSON, with the duration in seconds
+// as feeds give it.
+type episodeJSON struct {
+	episode
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// episode has Episode's fields without its JSON methods.
+type episode Episode
+
+// MarshalJSON implements json.Marshaler.
+func (ep Episode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(episodeJSON{episode(ep), ep.Duration.Seconds()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ep *Episode) UnmarshalJSON(data []byte) error {
+	var v episodeJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*ep = Episode(v.episode)
+	ep.Duration = seconds(v.Duration)
+	return nil
+}
+
+// Downloader manages the downloading and tagging process.
+type Downloader struct {
+	OutputDir string
+	// DirMode and FileMode are the permissions of the directories and files
+	// a run creates, temporary ones included, before the umask; zero uses
+	// DefaultDirMode and DefaultFileMode. Existing ones are left as they are.
+	DirMode, FileMode os.FileMode
+	FeedURL           string
+	CoverURL          string
+	Concurrency       int    // Maximum number of episodes downloaded at once; 0 picks a count automatically.
+	Retries           int    // Maximum number of retries for a transient HTTP failure.
+	Artist            string // Artist tag for every episode; empty uses the feed author.
+	DryRun            bool   // List what would be downloaded without writing anything.
+	Playlist          bool   // Write playlist.m3u8 after downloading.
+	From, To          int    // Inclusive episode number range; 0 leaves a side unbounded.
+	Only              int    // Single episode number to process; 0 processes all.
+	Limit             int    // Only keep the newest Limit episodes; 0 keeps all.
+	Force             bool   // Ignore the state file and low disk space, verify every episode again.
+	RateLimit         int64  // Combined download speed cap in bytes per second; 0 is unlimited.
+	// RetryJitter randomizes each retry delay by up to this fraction of it,
+	// from 0 to 1. NewDownloader sets DefaultRetryJitter.
+	RetryJitter float64
+	// TagConcurrency is the maximum number of episodes tagged at once; 0
+	// uses the download worker count.
+	TagConcurrency int
+	// TitleRegex is tried before the built-in title formats; see
+	// CompileTitleRegex.
+	TitleRegex *regexp.Regexp
+	// NameTemplate renders episode filenames; nil uses DefaultNameTemplate.
+	// See ParseNameTemplate.
+	NameTemplate *template.Template
+	// Proxy is the HTTP or HTTPS proxy every request goes through. When nil,
+	// the proxy environment variables apply.
+	Proxy *url.URL
+	// RootCAs, if set, replaces the system roots when verifying servers'
+	// certificates, e.g. to trust a mirror signed by a private CA.
+	RootCAs *x509.CertPool
+	// Insecure accepts any server certificate. Only use it for a mirror you
+	// trust on a network you trust.
+	Insecure bool
+	// DownloadTimeout bounds how long a single episode download may take in
+	// total, however steadily data arrives. Zero means no limit.
+	DownloadTimeout time.Duration
+	// Progress, if set, receives a ProgressEvent as each episode is
+	// downloaded, tagged, completed or fails. Sends block, so the consumer
+	// must keep draining it (or make it buffered) for the run to progress.
+	// The channel is never closed; Run returning means no more events.
+	Progress chan<- ProgressEvent
+	// DryRunOutput receives the plan DryRun lists; nil uses os.Stdout.
+	DryRunOutput io.Writer
+	// Select, if set, is given the episodes found in the feed and returns
+	// those to process, e.g. after asking the user.
+	Select func(episodes []Episode) ([]Episode, error)
+	// ResumeAll scans OutputDir for partial downloads left by crashed runs
+	// and finishes them first, even for episodes outside the selection.
+	// Partial files of episodes no longer in the feed are logged.
+	ResumeAll bool
+	// OnComplete, if set, is called with the path of every episode once it
+	// has been downloaded and tagged, e.g. to import it elsewhere, or with
+	// the name given to Sink when one is set. Its error is logged and
+	// otherwise ignored.
+	OnComplete func(ctx context.Context, ep Episode, path string) error
+	// Sink is where episodes are streamed, already tagged; nil uses a
+	// FileSink on OutputDir. Another sink, e.g. to upload them, leaves
+	// OutputDir with the state, cover and feed cache, and the state is what
+	// tells which episodes are stored, since they can't be checked on disk.
+	// Only a FileSink resumes partial downloads. An episode the sink fails
+	// to store counts as failed and is tried again on the next run.
+	Sink Sink
+	// Metrics, if set, collects download counters and durations.
+	Metrics *Metrics
+	// NoCache fetches the whole feed on every run instead of revalidating
+	// the copy cached in OutputDir.
+	NoCache bool
+	// ByYear stores episodes in <year>/ subdirectories of OutputDir instead
+	// of directly in it. Episodes without a date go into "unknown".
+	ByYear bool
+	// PreferFormat picks the enclosure format when an item offers several,
+	// as an extension ("m4a") or MIME type ("audio/ogg"). MP3 is preferred
+	// when empty.
+	PreferFormat string
+	// AllowedTypes lists the enclosure MIME types worth downloading, such as
+	// "audio/mpeg" or "audio/*"; nil uses DefaultAllowedTypes. Enclosures
+	// without a type, or with a generic one like application/octet-stream,
+	// are judged by the extension of their URL instead.
+	AllowedTypes []string
+	// CheckContentType also checks the Content-Type of each enclosure
+	// response against AllowedTypes before saving it. Generic types pass.
+	CheckContentType bool
+	// Chapters writes chapter markers from the feed, or from a
+	// <name>.chapters.json file next to the episode, into the ID3 tag.
+	Chapters bool
+	// ID3v1 also writes an ID3v1 tag for players that can't read ID3v2.
+	ID3v1 bool
+	// Order is the order episodes are processed and listed in the playlist:
+	// OrderAsc (the default when empty), OrderDesc or OrderFeed.
+	Order string
+	// TagPadding is how many bytes of padding to reserve after the ID3v2
+	// tag when a file has to be rewritten to fit it, so later retags can
+	// update the tag in place. NewDownloader sets DefaultTagPadding.
+	TagPadding int64
+	// AlbumArtist is the album artist tag (TPE2) of every episode; empty
+	// uses Artist, then the feed author.
+	AlbumArtist string
+	// CheckRemoteSize asks the server for the size of every episode already
+	// on disk, with a HEAD request each, and downloads it again if the size
+	// changed since it was downloaded.
+	CheckRemoteSize bool
+	// StrictTags treats any episode that can't be fully tagged as failed,
+	// including formats other than MP3, and counts a file as tagged only
+	// once it has every frame tagEpisode would write for it.
+	StrictTags bool
+	// CommentURL appends the enclosure URL to the comment tag, to record
+	// where each file came from.
+	CommentURL bool
+	// MaxTotalSize caps how many bytes a run downloads, judged by the
+	// episodes' expected sizes; episodes past the cap are left for a later
+	// run. Zero is unlimited. Episodes whose size isn't known count as
+	// empty.
+	MaxTotalSize int64
+	// Since, if set, skips episodes published before it. Episodes without a
+	// date are skipped too, unless IncludeUndated is set.
+	Since          time.Time
+	IncludeUndated bool
+	// Album is the album tag of every episode; empty uses DefaultAlbum.
+	Album string
+	// RequiredFrames lists the ID3v2 frame IDs an episode must have, besides
+	// matching album, title, track and artist values, before it is
+	// considered tagged. Nil uses DefaultRequiredFrames; an empty slice
+	// requires none.
+	RequiredFrames []string
+	Episodes       []Episode
+	// Skipped lists the feed items the last feed load dropped, e.g. for
+	// lacking an audio enclosure.
+	Skipped []SkippedItem
+	// FeedStats counts what the last feed load did with the feed's items.
+	FeedStats FeedStats
+	// NoCover leaves images out of the tags: neither the cover nor any
+	// Artwork is fetched or embedded, and files count as tagged without
+	// one. Images already in a file are kept.
+	NoCover bool
+	// CheckCover counts a file as tagged only if its embedded cover is the
+	// current cover image, so replacing the cover and re-checking the files
+	// updates it everywhere.
+	CheckCover bool
+	// PerEpisodeArt embeds each episode's own artwork from the feed, when
+	// it has one, instead of the cover.
+	PerEpisodeArt bool
+	// Artwork lists images embedded in every episode besides the cover,
+	// e.g. a back cover. Existing files get them when they are next
+	// re-tagged.
+	Artwork []Artwork
+
+	// Client sends every request. It has no overall timeout so large
+	// episodes can take as long as they need; Timeout bounds the rest.
+	// Point it at an httptest.Server transport to run without the network.
+	Client *http.Client
+	// Parser loads the feed; nil fetches it with Client and parses it
+	// with gofeed.
+	Parser FeedParser
+	// Timeout limits the feed, cover and HEAD requests, and how long an
+	// episode download may go without receiving data. It applies to each
+	// attempt, not counting the waits between retries. Zero disables it.
+	Timeout time.Duration
+	// UserAgent is sent with every request, including the feed fetch.
+	UserAgent string
+	// FeedAuth (basic auth) or BearerToken authenticate with a private
+	// feed. They are sent with every request to the feed's host, enclosures
+	// and cover included, but never to another host.
+	FeedAuth    *url.Userinfo
+	BearerToken string
+	// MaxRedirects caps how many redirects a single request may follow.
+	MaxRedirects int
+
+	// LogOutput receives log lines, os.Stderr if nil. LogLevel and JSONLogs
+	// pick the verbosity and format; they are read on first use.
+	LogOutput io.Writer
+	LogLevel  slog.Level
+	JSONLogs  bool
+
+	progress     *progressRenderer    // Draws download progress; nil when disabled.
+	numberWidth  int                  // Digits episode numbers are padded to in filenames.
+	state        *downloadState       // Episodes completed by earlier runs.
+	limiter      *rateLimiter         // Shared by all downloads; nil when unlimited.
+	sums         *checksums           // Checksums of the files in OutputDir.
+	tagSlots     slots                // Limits concurrent tagging during a run.
+	stats        *runStats            // Counters for the current run.
+	feed         *gofeed.Feed         // The feed as last parsed.
+	artwork      []id3v2.PictureFrame // Artwork, loaded by fetchCover.
+	artMu        sync.Mutex           // Serializes fetching per-episode artwork.
+	coverSum     []byte               // SHA-256 of the cover, set by fetchCover for CheckCover.
+	feedEpisodes []Episode            // Every episode in the feed, before filtering.
+	logOnce      sync.Once
+	logOut       *logWriter
+	log          *slog.Logger
+}
+
+// NewDownloader creates a new Downloader instance with the default
+// concurrency, retry, timeout and redirect settings.
+func NewDownloader(outDir, feedURL, coverURL string) *Downloader {
+	d := &Downloader{
+		OutputDir:    outDir,
+		FeedURL:      feedURL,
+		CoverURL:     coverURL,
+		Concurrency:  DefaultConcurrency,
+		Retries:      DefaultRetries,
+		RetryJitter:  DefaultRetryJitter,
+		Timeout:      DefaultTimeout,
+		UserAgent:    DefaultUserAgent,
+		MaxRedirects: DefaultRedirects,
+		TagPadding:   DefaultTagPadding,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = d.proxy
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+	// Verification is done in verifyConnection so that RootCAs and Insecure
+	// can still be set after NewDownloader returns, like Proxy.
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   d.verifyConnection,
+	}
+	d.Client = &http.Client{Transport: transport, CheckRedirect: d.checkRedirect}
+	return d
+}
+
+// proxy sends requests through d.Proxy when it's set, and otherwise through
+// the proxy named by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables.
+func (d *Downloader) proxy(req *http.Request) (*url.URL, error) {
+	if d.Proxy != nil {
+		return d.Proxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// verifyConnection checks the server's certificate chain and host name
+// against d.RootCAs, or the system roots, unless d.Insecure is set.
+func (d *Downloader) verifyConnection(cs tls.ConnectionState) error {
+	if d.Insecure {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errNoCertificate
+	}
+	opts := x509.VerifyOptions{
+		Roots:         d.RootCAs,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// checkRedirect caps the number of redirects at d.MaxRedirects and keeps the
+// Range header of a resumed download on every hop. Credentials are dropped
+// on a redirect to another host or scheme.
+func (d *Downloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > d.MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, d.MaxRedirects)
+	}
+	if !sameOrigin(via[0].URL, req.URL) {
+		req.Header.Del("Authorization")
+	}
+	if r := via[0].Header.Get("Range"); r != "" {
+		req.Header.Set("Range", r)
+	}
+	return nil
+}
+
+// Run performs the full pipeline: it prepares the output directory, fetches
+// the cover, loads the feed and downloads and tags every episode. Failures of
+// individual episodes are logged and don't stop the others; afterwards Run
+// returns an error wrapping ErrEpisodesFailed. Any other error means the run
+// as a whole could not proceed or was cancelled through ctx.
+func (d *Downloader) Run(ctx context.Context) error {
+	if !d.DryRun {
+		if err := d.prepareOutput(); err != nil {
+			return fmt.Errorf("failed to prepare output directory: %w", err)
+		}
+		unlock, err := d.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	state, err := loadState(d.OutputDir, d.Force, d.fileMode())
+	if err != nil {
+		return err
+	}
+	d.state = state
+	sums, err := loadChecksums(d.OutputDir, d.fileMode())
+	if err != nil {
+		return err
+	}
+	d.sums = sums
+	if d.RateLimit > 0 {
+		d.limiter = newRateLimiter(d.RateLimit) // The cover counts too.
+	}
+
+	// The cover and the feed don't depend on each other, so fetch them in
+	// parallel. Tagging needs the cover on disk, so both must finish before
+	// any episode is processed.
+	g, gctx := errgroup.WithContext(ctx)
+	if !d.DryRun {
+		g.Go(func() error { return d.fetchCover(gctx) })
+	}
+	g.Go(func() error { return d.loadEpisodes(gctx) })
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if d.Select != nil {
+		episodes, err := d.Select(d.Episodes)
+		if err != nil {
+			return err
+		}
+		d.Episodes = episodes
+	}
+	if d.ResumeAll {
+		if err := d.resumeAll(ctx); err != nil {
+			return err
+		}
+	}
+	// The playlist still lists the episodes that did succeed.
+	err = d.downloadAndTagEpisodes(ctx)
+	if err != nil && !errors.Is(err, ErrEpisodesFailed) {
+		return err
+	}
+	if d.Playlist && !d.DryRun {
+		if err := d.generatePlaylist(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// prepareOutput ensures the output directory exists.
+func (d *Downloader) prepareOutput() error {
+	return os.MkdirAll(d.OutputDir, d.dirMode())
+}
+
+// dirMode returns the permissions for new directories.
+func (d *Downloader) dirMode() os.FileMode {
+	if d.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return d.DirMode
+}
+
+// fileMode returns the permissions for new files.
+func (d *Downloader) fileMode() os.FileMode {
+	if d.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return d.FileMode
+}
+
+// coverFiles maps the supported cover image types to the name the cover is
+// saved under in the output directory.
+var coverFiles = map[string]string{
+	"image/jpeg": "cover.jpg",
+	"image/png":  "cover.png",
+}
+
+// coverPath returns the cover image in the output directory, in whichever
+// format it was saved.
+func (d *Downloader) coverPath() string {
+	for _, name := range []string{"cover.jpg", "cover.png"} {
+		path := filepath.Join(d.OutputDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(d.OutputDir, "cover.jpg")
+}
+
+// localImagePath returns the filesystem path an image source refers to, if
+// it isn't an http(s) URL.
+func localImagePath(src string) (string, bool) {
+	u, err := url.Parse(src)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		return "", false
+	case err == nil && u.Scheme == "file":
+		return u.Path, true
+	}
+	return src, true
+}
+
+// fetchCover saves the front cover and loads the additional artwork, unless
+// d.NoCover is set.
+func (d *Downloader) fetchCover(ctx context.Context) error {
+	if d.NoCover {
+		return nil
+	}
+	if err := d.saveCover(ctx); err != nil {
+		return err
+	}
+	if d.CheckCover {
+		cover, err := os.ReadFile(d.coverPath())
+		if err != nil {
+			return fmt.Errorf("failed to read cover: %w", err)
+		}
+		sum := sha256.Sum256(cover)
+		d.coverSum = sum[:]
+	}
+	return d.fetchArtwork(ctx)
+}
+
+// saveCover saves the cover image to the output directory as cover.jpg or
+// cover.png, depending on its content. A downloaded cover is kept for later
+// runs, unless it isn't a valid image; a local file is copied every time so
+// changes to it are picked up. The file is replaced atomically, so an
+// interrupted run can't leave a broken cover to be embedded in every episode.
+func (d *Downloader) saveCover(ctx context.Context) error {
+	var image []byte
+	if path, ok := localImagePath(d.CoverURL); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read cover: %w", err)
+		}
+		image = data
+	} else {
+		if validCover(d.coverPath()) {
+			return nil // Cover already exists.
+		}
+		data, err := d.downloadImage(ctx, d.CoverURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch cover: %w", err)
+		}
+		image = data
+	}
+
+	// Go by the content rather than the URL or Content-Type, which are often
+	// wrong for images.
+	mimeType := http.DetectContentType(image)
+	name, ok := coverFiles[mimeType]
+	if !ok {
+		return fmt.Errorf("unsupported cover image type %s from %s", mimeType, d.CoverURL)
+	}
+	for _, other := range coverFiles {
+		if other != name {
+			os.Remove(filepath.Join(d.OutputDir, other)) // Don't let a stale cover win.
+		}
+	}
+	path := filepath.Join(d.OutputDir, name)
+	if err := os.WriteFile(path+".tmp", image, d.fileMode()); err != nil {
+		return fmt.Errorf("failed to write cover file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write cover file: %w", err)
+	}
+	d.logger().Info("Cover image saved", "file", name)
+	return nil
+}
+
+// validCover reports whether the file at path is a cover image saved
+// under the name matching its type.
+func validCover(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512) // All DetectContentType looks at.
+	n, _ := io.ReadFull(f, head)
+	return coverFiles[http.DetectContentType(head[:n])] == filepath.Base(path)
+}
+
+// downloadImage fetches the image at rawURL.
+func (d *Downloader) downloadImage(ctx context.Context, rawURL string) ([]byte, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, redactURL(rawURL))
+	}
+	var body io.Reader = resp.Body
+	if d.limiter != nil {
+		body = &throttledReader{ctx: ctx, r: body, limiter: d.limiter}
+	}
+	image, err := io.ReadAll(io.LimitReader(body, maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > maxImageSize {
+		return nil, fmt.Errorf("image at %s is larger than %s", redactURL(rawURL), formatSize(maxImageSize))
+	}
+	return image, nil
+}
+
+// maxImageSize caps the size of a downloaded cover, which is held in memory
+// and embedded in every episode.
+const maxImageSize = 20 << 20
+
+// withTimeout bounds ctx by d.Timeout, if one is set. getWithRetry starts
+// the timeout over after each wait between attempts.
+func (d *Downloader) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(d.Timeout, func() {
+		cancel(fmt.Errorf("request took longer than %s", d.Timeout))
+	})
+	return withAttemptTimeout(ctx, timer, d.Timeout), func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
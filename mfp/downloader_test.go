@@ -0,0 +1,67 @@
+package mfp
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// get sends a GET request for rawURL through d.
+func get(t *testing.T, d *Downloader, rawURL string) error {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.getWithRetry(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestVerifyConnection(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // Rejected handshakes are expected.
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	t.Run("default roots reject the server", func(t *testing.T) {
+		d := newTestDownloader(t, "")
+		var unknownAuthority x509.UnknownAuthorityError
+		if err := get(t, d, srv.URL); !errors.As(err, &unknownAuthority) {
+			t.Errorf("got error %v, want an unknown authority error", err)
+		}
+	})
+	t.Run("RootCAs accept the server", func(t *testing.T) {
+		d := newTestDownloader(t, "")
+		d.RootCAs = pool
+		if err := get(t, d, srv.URL); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+	})
+	t.Run("RootCAs still check the host name", func(t *testing.T) {
+		d := newTestDownloader(t, "")
+		d.RootCAs = pool
+		// The test certificate is for 127.0.0.1 and example.com only.
+		var hostname x509.HostnameError
+		if err := get(t, d, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)); !errors.As(err, &hostname) {
+			t.Errorf("got error %v, want a host name error", err)
+		}
+	})
+	t.Run("Insecure accepts the server", func(t *testing.T) {
+		d := newTestDownloader(t, "")
+		d.Insecure = true
+		if err := get(t, d, srv.URL); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+	})
+}
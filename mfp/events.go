@@ -0,0 +1,62 @@
+package mfp
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Phase is the stage an episode has reached in a ProgressEvent.
+type Phase string
+
+const (
+	PhaseDownloading Phase = "downloading"
+	PhaseTagging     Phase = "tagging"
+	PhaseComplete    Phase = "complete"
+	PhaseError       Phase = "error"
+)
+
+// ProgressEvent reports the progress of one episode on Downloader.Progress.
+type ProgressEvent struct {
+	Episode string // Episode number.
+	Phase   Phase
+	Bytes   int64 // Bytes downloaded so far, including a resumed part.
+	Total   int64 // Expected size in bytes, or 0 if unknown.
+	Err     error // Set for PhaseError.
+}
+
+// progressInterval is the minimum time between two PhaseDownloading events
+// for the same episode.
+const progressInterval = 200 * time.Millisecond
+
+// emit sends ev on d.Progress, if set. It blocks until the event is received
+// or ctx is done.
+func (d *Downloader) emit(ctx context.Context, ev ProgressEvent) {
+	if d.Progress == nil {
+		return
+	}
+	select {
+	case d.Progress <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// progressReader emits PhaseDownloading events while the episode body is
+// read, at most once per progressInterval.
+type progressReader struct {
+	ctx  context.Context
+	r    io.Reader
+	d    *Downloader
+	ev   ProgressEvent
+	last time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.ev.Bytes += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval || err == io.EOF {
+		p.last = now
+		p.d.emit(p.ctx, p.ev)
+	}
+	return n, err
+}
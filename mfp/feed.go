@@ -0,0 +1,564 @@
+package mfp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// FeedParser fetches and parses a feed. *gofeed.Parser satisfies it; tests
+// can substitute a canned feed.
+type FeedParser interface {
+	ParseURLWithContext(feedURL string, ctx context.Context) (*gofeed.Feed, error)
+}
+
+// titlePatterns are the built-in title formats, tried in order. Each has a
+// "number" and a "title" named group.
+var titlePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^Episode\s+(?P<number>\d+):\s*(?P<title>.+)$`),
+	regexp.MustCompile(`^Ep\.?\s*(?P<number>\d+)\s*[-:–]\s*(?P<title>.+)$`),
+	regexp.MustCompile(`^#(?P<number>\d+)\s*[-:]?\s*(?P<title>.+)$`),
+}
+
+// CompileTitleRegex compiles a custom title pattern, which must have
+// "number" and "title" named capture groups.
+func CompileTitleRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("number") < 0 || re.SubexpIndex("title") < 0 {
+		return nil, fmt.Errorf("title regex %q needs (?P<number>...) and (?P<title>...) groups", expr)
+	}
+	return re, nil
+}
+
+// parseTitle extracts the episode number and title from an item title using
+// d.TitleRegex, then the built-in patterns.
+func (d *Downloader) parseTitle(title string) (number, name string, ok bool) {
+	patterns := titlePatterns
+	if d.TitleRegex != nil {
+		patterns = append([]*regexp.Regexp{d.TitleRegex}, titlePatterns...)
+	}
+	for _, re := range patterns {
+		m := re.FindStringSubmatch(title)
+		if m == nil {
+			continue
+		}
+		number = m[re.SubexpIndex("number")]
+		name = strings.TrimSpace(m[re.SubexpIndex("title")])
+		if number != "" && name != "" {
+			return number, name, true
+		}
+	}
+	return "", "", false
+}
+
+// Episode orders for Downloader.Order.
+const (
+	OrderAsc  = "asc"  // Oldest first.
+	OrderDesc = "desc" // Newest first.
+	OrderFeed = "feed" // As listed in the feed.
+)
+
+// ErrNoEpisodes is returned when the feed has no items with an audio
+// enclosure, which usually means the feed URL is wrong.
+var ErrNoEpisodes = errors.New("no episodes found in the feed")
+
+// Reasons a feed item is dropped, in SkippedItem.Reason.
+var (
+	ErrNoEnclosure      = errors.New("no audio enclosure")
+	ErrTypeNotAllowed   = errors.New("enclosure type not allowed")
+	ErrDuplicateEpisode = errors.New("duplicate episode number")
+)
+
+// SkippedItem is a feed item that loadEpisodes dropped, and why. Items left
+// out by the episode filters, such as From and To, aren't listed.
+type SkippedItem struct {
+	Title  string
+	Number string // Episode number, if the title was parsed.
+	Reason error
+}
+
+// FeedStats counts what a feed load did with the feed's items.
+type FeedStats struct {
+	Items          int // Items in the feed.
+	Episodes       int // Items kept as episodes, before the range, date and limit filters.
+	Selected       int // Episodes left after the filters.
+	NoEnclosure    int // Items dropped for having no enclosure.
+	TypeNotAllowed int // Items dropped for having no enclosure of an allowed type.
+	Duplicates     int // Items dropped for repeating another item's episode number.
+	UnparsedTitles int // Episodes kept under their raw title, which didn't parse.
+}
+
+// LogValue implements slog.LogValuer.
+func (s FeedStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("items", s.Items),
+		slog.Int("episodes", s.Episodes),
+		slog.Int("selected", s.Selected),
+		slog.Int("no_enclosure", s.NoEnclosure),
+		slog.Int("type_not_allowed", s.TypeNotAllowed),
+		slog.Int("duplicates", s.Duplicates),
+		slog.Int("unparsed_titles", s.UnparsedTitles),
+	)
+}
+
+// skip records a dropped feed item in d.Skipped and counts it in
+// d.FeedStats.
+func (d *Downloader) skip(title, number string, reason error) {
+	d.Skipped = append(d.Skipped, SkippedItem{Title: title, Number: number, Reason: reason})
+	switch reason {
+	case ErrNoEnclosure:
+		d.FeedStats.NoEnclosure++
+	case ErrTypeNotAllowed:
+		d.FeedStats.TypeNotAllowed++
+	case ErrDuplicateEpisode:
+		d.FeedStats.Duplicates++
+	}
+}
+
+// LoadFeed loads the feed and selects the episodes to process into
+// d.Episodes, as Run does, without downloading anything. It returns what was
+// done with the feed's items, which d.FeedStats and d.Skipped also hold.
+func (d *Downloader) LoadFeed(ctx context.Context) (FeedStats, error) {
+	err := d.loadEpisodes(ctx)
+	return d.FeedStats, err
+}
+
+// loadEpisodes parses the RSS feed and creates a list of episodes,
+// reformatting titles such as "Episode XX: Title" to "XX - Title".
+func (d *Downloader) loadEpisodes(ctx context.Context) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	feed, err := d.parseFeed(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to parse feed: %w", err)
+	}
+	d.feed = feed
+	d.Episodes = nil
+	d.Skipped = nil
+	d.FeedStats = FeedStats{Items: len(feed.Items)}
+
+	matched := 0
+	for _, item := range feed.Items {
+		enc := d.pickEnclosure(item.Enclosures)
+		if enc == nil && len(item.Enclosures) > 0 {
+			d.logger().Warn("Enclosure type not allowed, skipping item", "title", item.Title, "types", enclosureTypes(item.Enclosures))
+			d.skip(item.Title, "", ErrTypeNotAllowed)
+			continue
+		}
+		if enc == nil {
+			d.logger().Warn("No audio enclosure, skipping item", "title", item.Title)
+			d.skip(item.Title, "", ErrNoEnclosure)
+			continue
+		}
+		number, title, ok := d.parseTitle(item.Title)
+		if ok {
+			matched++
+		} else {
+			// Keep the episode under its raw title; numberUntitled numbers
+			// it once every parsed number is known.
+			title = strings.TrimSpace(item.Title)
+			d.FeedStats.UnparsedTitles++
+			d.logger().Warn("Unrecognized title format, using the raw title", "title", item.Title)
+		}
+		size, _ := strconv.ParseInt(enc.Length, 10, 64)
+		ep := Episode{
+			Number:       number,
+			Title:        title,
+			URL:          enc.URL,
+			Ext:          audioExtension(enc.Type, enc.URL),
+			Artist:       d.episodeArtist(feed, item),
+			AlbumArtist:  d.albumArtist(feed),
+			Description:  stripHTML(item.Description),
+			Published:    item.PublishedParsed,
+			ExpectedSize: size,
+			Duration:     itemDuration(item),
+			Chapters:     feedChapters(item),
+			ChaptersURL:  feedChaptersURL(item),
+			ImageURL:     itemImage(item),
+		}
+		d.Episodes = append(d.Episodes, ep)
+	}
+	if len(d.Episodes) == 0 {
+		return fmt.Errorf("%w at %s", ErrNoEpisodes, redactURL(d.FeedURL))
+	}
+	if matched == 0 && d.TitleRegex != nil {
+		d.logger().Warn("No episode titles could be parsed, the title regex may not fit this feed", "regex", d.TitleRegex.String())
+	}
+
+	numberUntitled(d.Episodes)
+	d.dedupeEpisodes()
+	d.FeedStats.Episodes = len(d.Episodes)
+	d.numberWidth = numberWidth(d.Episodes)
+	d.feedEpisodes = slices.Clone(d.Episodes)
+	if err := d.filterSingle(); err != nil {
+		return err
+	}
+	d.filterRange()
+	d.filterSince()
+	// The feed lists the newest episodes first, so the limit keeps the latest.
+	if d.Limit > 0 && len(d.Episodes) > d.Limit {
+		d.logger().Info("Skipping older episodes beyond the limit", "skipped", len(d.Episodes)-d.Limit, "limit", d.Limit)
+		d.Episodes = d.Episodes[:d.Limit]
+	}
+
+	if err := d.orderEpisodes(); err != nil {
+		return err
+	}
+	if len(d.Episodes) == 0 {
+		d.logger().Warn("No episodes left after applying the episode range, date and limit", "from", d.From, "to", d.To)
+	}
+	d.FeedStats.Selected = len(d.Episodes)
+	d.logger().Info("Episodes found", "count", len(d.Episodes), "feed", d.FeedStats)
+	return nil
+}
+
+// orderEpisodes puts d.Episodes in d.Order. The feed is taken to list the
+// newest episode first, as podcast feeds do, and episodes are also sorted by
+// date when they all have one.
+func (d *Downloader) orderEpisodes() error {
+	switch d.Order {
+	case "", OrderAsc, OrderDesc:
+	case OrderFeed:
+		return nil
+	default:
+		return fmt.Errorf("unknown episode order %q", d.Order)
+	}
+	slices.Reverse(d.Episodes)
+	if !slices.ContainsFunc(d.Episodes, func(ep Episode) bool { return ep.Published == nil }) {
+		slices.SortStableFunc(d.Episodes, func(a, b Episode) int {
+			return a.Published.Compare(*b.Published)
+		})
+	}
+	if d.Order == OrderDesc {
+		slices.Reverse(d.Episodes)
+	}
+	return nil
+}
+
+// ExportJSON loads the feed and writes the parsed episodes to w as a JSON
+// array, without downloading anything.
+func (d *Downloader) ExportJSON(ctx context.Context, w io.Writer) error {
+	if err := d.loadEpisodes(ctx); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d.Episodes); err != nil {
+		return fmt.Errorf("failed to write episode list: %w", err)
+	}
+	return nil
+}
+
+// htmlTag matches an HTML tag in a feed description.
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// stripHTML turns an HTML description into plain text.
+func stripHTML(s string) string {
+	s = htmlTag.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// audioExtensions maps enclosure MIME types to file extensions.
+var audioExtensions = map[string]string{
+	"audio/mpeg":  ".mp3",
+	"audio/mp3":   ".mp3",
+	"audio/ogg":   ".ogg",
+	"audio/opus":  ".opus",
+	"audio/mp4":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/aac":   ".aac",
+	"audio/flac":  ".flac",
+	"audio/wav":   ".wav",
+	"audio/x-wav": ".wav",
+}
+
+// audioExtension derives the file extension for an enclosure from its MIME
+// type, falling back to the URL path, lowercased, and finally to ".mp3". An
+// extension that isn't a known audio format, e.g. from a "download.php" URL,
+// is ignored.
+func audioExtension(mimeType, rawURL string) string {
+	if ext, ok := audioExtensions[strings.ToLower(strings.TrimSpace(mimeType))]; ok {
+		return ext
+	}
+	// Only the path counts: CDN URLs often carry a token in the query.
+	if u, err := url.Parse(rawURL); err == nil {
+		if ext, ok := FormatExtension(path.Ext(u.Path)); ok {
+			return ext
+		}
+	}
+	return ".mp3"
+}
+
+// FormatExtension turns a format given as an extension ("mp3", ".m4a") or a
+// MIME type ("audio/ogg") into the file extension used for it.
+func FormatExtension(format string) (string, bool) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if strings.Contains(format, "/") {
+		ext, ok := audioExtensions[format]
+		return ext, ok
+	}
+	ext := "." + strings.TrimPrefix(format, ".")
+	for _, known := range audioExtensions {
+		if ext == known {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+// pickEnclosure returns the audio enclosure in the format of d.PreferFormat,
+// MP3 by default, or else the first allowed enclosure. Enclosures outside
+// d.AllowedTypes, such as chapter or transcript files, are never picked.
+func (d *Downloader) pickEnclosure(encs []*gofeed.Enclosure) *gofeed.Enclosure {
+	want := ".mp3"
+	if ext, ok := FormatExtension(d.PreferFormat); ok {
+		want = ext
+	}
+	var first *gofeed.Enclosure
+	for _, enc := range encs {
+		if !d.allowedEnclosure(enc) {
+			continue
+		}
+		if audioExtension(enc.Type, enc.URL) == want {
+			return enc
+		}
+		if first == nil {
+			first = enc
+		}
+	}
+	return first
+}
+
+// allowedEnclosure reports whether an enclosure is of a type in
+// d.AllowedTypes, going by its URL when the type is missing or generic.
+func (d *Downloader) allowedEnclosure(enc *gofeed.Enclosure) bool {
+	mimeType := mediaType(enc.Type)
+	if !genericType(mimeType) {
+		return d.allowedType(mimeType)
+	}
+	u, err := url.Parse(enc.URL)
+	if err != nil {
+		return false
+	}
+	_, ok := FormatExtension(path.Ext(u.Path))
+	return ok
+}
+
+// allowedType reports whether mimeType matches one of d.AllowedTypes, where
+// "audio/*" stands for every audio type.
+func (d *Downloader) allowedType(mimeType string) bool {
+	allowed := d.AllowedTypes
+	if allowed == nil {
+		allowed = DefaultAllowedTypes
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == mimeType ||
+			strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the lowercased MIME type of a type or Content-Type
+// value, without parameters, or "" if it can't be parsed.
+func mediaType(value string) string {
+	mimeType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	return mimeType
+}
+
+// genericType reports whether a MIME type says nothing about the content.
+func genericType(mimeType string) bool {
+	return mimeType == "" || mimeType == "application/octet-stream" || mimeType == "binary/octet-stream"
+}
+
+// enclosureTypes lists the types of encs, for logs.
+func enclosureTypes(encs []*gofeed.Enclosure) []string {
+	types := make([]string, len(encs))
+	for i, enc := range encs {
+		types[i] = enc.Type
+	}
+	return types
+}
+
+// numberUntitled gives episodes whose title had no number the next numbers
+// after the highest parsed one, oldest first, so they never collide.
+func numberUntitled(episodes []Episode) {
+	highest := 0
+	for _, ep := range episodes {
+		if n, err := strconv.Atoi(ep.Number); err == nil && n > highest {
+			highest = n
+		}
+	}
+	// Episodes are still in feed order, newest first.
+	for i := len(episodes) - 1; i >= 0; i-- {
+		if episodes[i].Number == "" {
+			highest++
+			episodes[i].Number = strconv.Itoa(highest)
+		}
+	}
+}
+
+// dedupeEpisodes drops episodes that repeat an earlier episode number, which
+// would otherwise download to the same file. The copy with the larger
+// enclosure wins, and the first one listed on a tie.
+func (d *Downloader) dedupeEpisodes() {
+	index := make(map[string]int, len(d.Episodes))
+	kept := d.Episodes[:0]
+	for _, ep := range d.Episodes {
+		key := ep.Number
+		if n, err := strconv.Atoi(ep.Number); err == nil {
+			key = strconv.Itoa(n) // "07" and "7" are the same episode.
+		}
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(kept)
+			kept = append(kept, ep)
+			continue
+		}
+		if ep.ExpectedSize > kept[i].ExpectedSize {
+			d.logger().Warn("Duplicate episode number, keeping the larger enclosure", "episode", ep.Number, "skipped", kept[i].Title)
+			d.skip(kept[i].Title, kept[i].Number, ErrDuplicateEpisode)
+			kept[i] = ep
+		} else {
+			d.logger().Warn("Duplicate episode number, skipping", "episode", ep.Number, "skipped", ep.Title)
+			d.skip(ep.Title, ep.Number, ErrDuplicateEpisode)
+		}
+	}
+	d.Episodes = kept
+}
+
+// numberWidth returns how many digits the highest episode number needs, and
+// at least two, so that padded filenames sort in episode order.
+func numberWidth(episodes []Episode) int {
+	width := 2
+	for _, ep := range episodes {
+		n, err := strconv.Atoi(ep.Number)
+		if err != nil {
+			continue
+		}
+		if w := len(strconv.Itoa(n)); w > width {
+			width = w
+		}
+	}
+	return width
+}
+
+// filterSingle keeps only episode d.Only, if set, and fails with the range of
+// available numbers when the feed doesn't have it.
+func (d *Downloader) filterSingle() error {
+	if d.Only == 0 {
+		return nil
+	}
+	lowest, highest := 0, 0
+	for _, ep := range d.Episodes {
+		n, err := strconv.Atoi(ep.Number)
+		if err != nil {
+			continue
+		}
+		if n == d.Only {
+			d.Episodes = []Episode{ep}
+			return nil
+		}
+		if lowest == 0 || n < lowest {
+			lowest = n
+		}
+		highest = max(highest, n)
+	}
+	return fmt.Errorf("episode %d not found in the feed, whose episode numbers range from %d to %d", d.Only, lowest, highest)
+}
+
+// filterRange drops episodes whose number falls outside d.From..d.To.
+func (d *Downloader) filterRange() {
+	if d.From == 0 && d.To == 0 {
+		return
+	}
+	kept := d.Episodes[:0]
+	for _, ep := range d.Episodes {
+		n, err := strconv.Atoi(ep.Number)
+		if err != nil {
+			continue
+		}
+		if (d.From != 0 && n < d.From) || (d.To != 0 && n > d.To) {
+			continue
+		}
+		kept = append(kept, ep)
+	}
+	d.logger().Info("Filtered out episodes outside the requested range", "skipped", len(d.Episodes)-len(kept))
+	d.Episodes = kept
+}
+
+// filterSince drops episodes published before d.Since, and those without a
+// date unless d.IncludeUndated is set.
+func (d *Downloader) filterSince() {
+	if d.Since.IsZero() {
+		return
+	}
+	kept := d.Episodes[:0]
+	undated := 0
+	for _, ep := range d.Episodes {
+		switch {
+		case ep.Published == nil:
+			if !d.IncludeUndated {
+				undated++
+				continue
+			}
+		case ep.Published.Before(d.Since):
+			continue
+		}
+		kept = append(kept, ep)
+	}
+	d.logger().Info("Filtered out episodes published before the start date", "skipped", len(d.Episodes)-len(kept), "undated", undated, "since", d.Since.Format(time.DateOnly))
+	d.Episodes = kept
+}
+
+// episodeArtist picks the artist tag for an item: the configured artist if
+// set, otherwise the item author, otherwise the feed author.
+func (d *Downloader) episodeArtist(feed *gofeed.Feed, item *gofeed.Item) string {
+	if d.Artist != "" {
+		return d.Artist
+	}
+	if item.Author != nil && item.Author.Name != "" {
+		return item.Author.Name
+	}
+	if feed.Author != nil && feed.Author.Name != "" {
+		return feed.Author.Name
+	}
+	return ""
+}
+
+// albumArtist picks the album artist tag, which groups the episodes
+// together in music libraries: the configured album artist or artist if
+// set, otherwise the feed author.
+func (d *Downloader) albumArtist(feed *gofeed.Feed) string {
+	switch {
+	case d.AlbumArtist != "":
+		return d.AlbumArtist
+	case d.Artist != "":
+		return d.Artist
+	case feed.Author != nil:
+		return feed.Author.Name
+	}
+	return ""
+}
@@ -0,0 +1,224 @@
+package mfp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// fixtureFeed lists its episodes newest first, as podcast feeds do, with a
+// title in each built-in format, one the patterns don't know and an item
+// without an enclosure.
+var fixtureFeed = rss(
+	item("Unnumbered Special", "/special.mp3", 400, date(5)),
+	item("#3 - Third", "/03.mp3", 3000, date(4)),
+	item("Ep. 2 - Second", "/02.mp3", 2000, date(3)),
+	item("Episode 01: First", "/01.mp3", 1000, date(2)),
+	item("Episode 00: Trailer", "", 0, date(1)),
+)
+
+// episodeNumbers returns the numbers of episodes, in order.
+func episodeNumbers(episodes []Episode) []string {
+	numbers := make([]string, len(episodes))
+	for i, ep := range episodes {
+		numbers[i] = ep.Number
+	}
+	return numbers
+}
+
+func TestLoadEpisodes(t *testing.T) {
+	srv, _ := serveFeed(t, fixtureFeed, nil)
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	if err := d.loadEpisodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Episode{
+		{Number: "01", Title: "First", URL: srv.URL + "/01.mp3", ExpectedSize: 1000},
+		{Number: "2", Title: "Second", URL: srv.URL + "/02.mp3", ExpectedSize: 2000},
+		{Number: "3", Title: "Third", URL: srv.URL + "/03.mp3", ExpectedSize: 3000},
+		// The title didn't parse, so it is kept as is and numbered after
+		// the others.
+		{Number: "4", Title: "Unnumbered Special", URL: srv.URL + "/special.mp3", ExpectedSize: 400},
+	}
+	if len(d.Episodes) != len(want) {
+		t.Fatalf("got episodes %v, want %v", episodeNumbers(d.Episodes), episodeNumbers(want))
+	}
+	for i, ep := range d.Episodes {
+		w := want[i]
+		if ep.Number != w.Number || ep.Title != w.Title || ep.URL != w.URL || ep.ExpectedSize != w.ExpectedSize {
+			t.Errorf("episode %d = %s %q %s %d, want %s %q %s %d", i,
+				ep.Number, ep.Title, ep.URL, ep.ExpectedSize, w.Number, w.Title, w.URL, w.ExpectedSize)
+		}
+		if ep.Ext != ".mp3" || ep.Artist != "Test Artist" || ep.Published == nil {
+			t.Errorf("episode %s has ext %q, artist %q, published %v", ep.Number, ep.Ext, ep.Artist, ep.Published)
+		}
+	}
+
+	if len(d.Skipped) != 1 || !errors.Is(d.Skipped[0].Reason, ErrNoEnclosure) {
+		t.Errorf("Skipped = %+v, want the trailer for lacking an enclosure", d.Skipped)
+	}
+	wantStats := FeedStats{Items: 5, Episodes: 4, Selected: 4, NoEnclosure: 1, UnparsedTitles: 1}
+	if d.FeedStats != wantStats {
+		t.Errorf("FeedStats = %+v, want %+v", d.FeedStats, wantStats)
+	}
+}
+
+func TestLoadEpisodesOrder(t *testing.T) {
+	srv, _ := serveFeed(t, fixtureFeed, nil)
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"", []string{"01", "2", "3", "4"}},
+		{OrderAsc, []string{"01", "2", "3", "4"}},
+		{OrderDesc, []string{"4", "3", "2", "01"}},
+		{OrderFeed, []string{"4", "3", "2", "01"}},
+	}
+	for _, tt := range tests {
+		d := newTestDownloader(t, srv.URL+"/feed.xml")
+		d.Order = tt.order
+		if err := d.loadEpisodes(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := episodeNumbers(d.Episodes); !slices.Equal(got, tt.want) {
+			t.Errorf("order %q: got episodes %v, want %v", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEpisodesWithParser(t *testing.T) {
+	srv, _ := serveFeed(t, fixtureFeed, nil)
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	d.Parser = gofeed.NewParser()
+	if err := d.loadEpisodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := episodeNumbers(d.Episodes); !slices.Equal(got, []string{"01", "2", "3", "4"}) {
+		t.Errorf("got episodes %v through the custom parser", got)
+	}
+}
+
+func TestDedupeEpisodes(t *testing.T) {
+	srv, _ := serveFeed(t, rss(
+		item("Episode 08: Second", "/08.mp3", 300, date(3)),
+		item("Episode 08: Second again", "/08b.mp3", 300, date(3)),
+		item("Episode 7: First (remaster)", "/07b.mp3", 200, date(2)),
+		item("Episode 07: First", "/07.mp3", 100, date(1)),
+	), nil)
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	if err := d.loadEpisodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Episodes) != 2 {
+		t.Fatalf("got %d episodes, want 2: %+v", len(d.Episodes), d.Episodes)
+	}
+	// The larger enclosure wins, and the first one listed on a tie.
+	if got := d.Episodes[0]; got.Number != "7" || got.Title != "First (remaster)" {
+		t.Errorf("kept episode 7 = %s %q, want the remaster", got.Number, got.Title)
+	}
+	if got := d.Episodes[1]; got.Number != "08" || got.Title != "Second" {
+		t.Errorf("kept episode 8 = %s %q, want the first listed", got.Number, got.Title)
+	}
+	if len(d.Skipped) != 2 {
+		t.Fatalf("got %d skipped items, want 2: %+v", len(d.Skipped), d.Skipped)
+	}
+	for _, skipped := range d.Skipped {
+		if !errors.Is(skipped.Reason, ErrDuplicateEpisode) {
+			t.Errorf("skipped %q for %v, want %v", skipped.Title, skipped.Reason, ErrDuplicateEpisode)
+		}
+	}
+	if d.FeedStats.Duplicates != 2 {
+		t.Errorf("FeedStats.Duplicates = %d, want 2", d.FeedStats.Duplicates)
+	}
+}
+
+func TestLoadEpisodesEmptyFeed(t *testing.T) {
+	feeds := map[string]string{
+		"no items":         rss(),
+		"no enclosures":    rss(item("Episode 01: First", "", 0, date(1))),
+		"not audio at all": rss(`<item><title>Episode 01: First</title><enclosure url="SERVER/notes.pdf" length="10" type="application/pdf"/></item>`),
+	}
+	for name, feed := range feeds {
+		srv, _ := serveFeed(t, feed, nil)
+		d := newTestDownloader(t, srv.URL+"/feed.xml")
+		if err := d.loadEpisodes(context.Background()); !errors.Is(err, ErrNoEpisodes) {
+			t.Errorf("%s: loadEpisodes error = %v, want %v", name, err, ErrNoEpisodes)
+		}
+	}
+}
+
+func TestAudioExtension(t *testing.T) {
+	tests := []struct {
+		mimeType, url, want string
+	}{
+		{"audio/mpeg", "https://cdn.example.com/ep.m4a", ".mp3"},
+		{" Audio/OGG ", "https://cdn.example.com/ep", ".ogg"},
+		{"", "https://cdn.example.com/ep.M4A?token=abc.mp3", ".m4a"},
+		{"", "https://cdn.example.com/ep.MP3?token=x.php", ".mp3"},
+		{"application/octet-stream", "https://cdn.example.com/ep.opus#t=10.php", ".opus"},
+		{"", "https://cdn.example.com/download.php?id=1.ogg", ".mp3"},
+		{"", "https://cdn.example.com/ep", ".mp3"},
+		{"audio/x-unknown", "https://cdn.example.com/ep.xyz", ".mp3"},
+	}
+	for _, tt := range tests {
+		if got := audioExtension(tt.mimeType, tt.url); got != tt.want {
+			t.Errorf("audioExtension(%q, %q) = %q, want %q", tt.mimeType, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLoadFeedTwice(t *testing.T) {
+	srv, _ := serveFeed(t, fixtureFeed, nil)
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	ctx := context.Background()
+	first, err := d.LoadFeed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.LoadFeed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || second.Duplicates != 0 {
+		t.Errorf("second LoadFeed stats = %+v, want %+v", second, first)
+	}
+	if len(d.Episodes) != first.Selected {
+		t.Errorf("got %d episodes after loading twice, want %d", len(d.Episodes), first.Selected)
+	}
+}
+
+func TestEpisodeDuration(t *testing.T) {
+	srv, _ := serveFeed(t, rss(`<item><title>Episode 01: First</title><itunes:duration>1:02:33.5</itunes:duration><enclosure url="SERVER/01.mp3" length="10" type="audio/mpeg"/></item>`), nil)
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	if err := d.loadEpisodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ep := d.Episodes[0]
+	if want := time.Hour + 2*time.Minute + 33500*time.Millisecond; ep.Duration != want {
+		t.Fatalf("Duration = %s, want %s", ep.Duration, want)
+	}
+
+	// JSON keeps the duration in seconds.
+	data, err := json.Marshal(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"duration":3753.5`) {
+		t.Errorf("JSON lacks the duration in seconds: %s", data)
+	}
+	var back Episode
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Duration != ep.Duration || back.Title != ep.Title || back.URL != ep.URL {
+		t.Errorf("decoded %+v, want %+v", back, ep)
+	}
+}
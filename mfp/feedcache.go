@@ -0,0 +1,197 @@
+package mfp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// Cached copy of the feed and the validators the server sent with it, kept
+// in the output directory.
+const (
+	feedCacheFile     = ".feed.xml"
+	feedCacheMetaFile = ".feed.json"
+)
+
+// feedCacheMeta holds the validators for the cached feed. URL guards against
+// reusing a cache made for a different -feed.
+type feedCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// parseFeed fetches and parses the feed. Unless caching is disabled or a
+// custom Parser is set, the request is conditional on the cached copy and a
+// 304 response reuses it. A local feed is read directly.
+func (d *Downloader) parseFeed(ctx context.Context) (*gofeed.Feed, error) {
+	if path, ok := localFeedPath(d.FeedURL); ok {
+		return parseLocalFeed(path)
+	}
+	if d.Parser != nil {
+		return d.Parser.ParseURLWithContext(d.FeedURL, ctx)
+	}
+	data, err := d.fetchFeed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gofeed.NewParser().Parse(bytes.NewReader(data))
+}
+
+// gunzipFeed returns data decompressed if it is gzipped, and unchanged
+// otherwise. The transport already undoes Content-Encoding: gzip, but some
+// servers serve a compressed feed (feed.xml.gz) without saying so.
+func gunzipFeed(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress feed: %w", err)
+	}
+	defer r.Close()
+	data, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress feed: %w", err)
+	}
+	return data, nil
+}
+
+// localFeedPath returns the file to read the feed from when feedURL isn't an
+// HTTP or HTTPS URL: a path, a file:// URL, or "-" for stdin.
+func localFeedPath(feedURL string) (string, bool) {
+	if feedURL == "-" {
+		return feedURL, true
+	}
+	u, err := url.Parse(feedURL)
+	switch {
+	case err != nil:
+		return feedURL, true // Not a URL, e.g. a Windows path.
+	case u.Scheme == "http" || u.Scheme == "https":
+		return "", false
+	case u.Scheme == "file":
+		return u.Path, true
+	}
+	return feedURL, true
+}
+
+// parseLocalFeed parses the feed in the file at path, or on stdin if path
+// is "-". The feed may be gzipped.
+func parseLocalFeed(path string) (*gofeed.Feed, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = gunzipFeed(data); err != nil {
+		return nil, err
+	}
+	return gofeed.NewParser().Parse(bytes.NewReader(data))
+}
+
+// fetchFeed returns the raw feed, either freshly downloaded or, when the
+// server reports it unchanged, from the cache. With d.NoCache the cached
+// copy is never reused. The cache is left untouched in dry-run mode.
+func (d *Downloader) fetchFeed(ctx context.Context) ([]byte, error) {
+	dataPath := filepath.Join(d.OutputDir, feedCacheFile)
+	metaPath := filepath.Join(d.OutputDir, feedCacheMetaFile)
+	var cached []byte
+	var meta feedCacheMeta
+	if !d.NoCache {
+		cached, meta = d.readFeedCache(dataPath, metaPath)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.FeedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		d.logger().Debug("Feed not modified, using the cached copy")
+		return cached, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = gunzipFeed(data); err != nil {
+		return nil, err
+	}
+	if !d.DryRun {
+		meta = feedCacheMeta{
+			URL:          d.FeedURL,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		// Nothing is cached before the output directory exists, e.g. for
+		// -list-json.
+		err := writeFeedCache(dataPath, metaPath, data, meta, d.fileMode())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			d.logger().Warn("Error caching feed", "err", err)
+		}
+	}
+	return data, nil
+}
+
+// readFeedCache loads the cached feed, returning nil data if there is no
+// usable cache for d.FeedURL.
+func (d *Downloader) readFeedCache(dataPath, metaPath string) ([]byte, feedCacheMeta) {
+	var meta feedCacheMeta
+	raw, err := os.ReadFile(metaPath)
+	if err != nil || json.Unmarshal(raw, &meta) != nil || meta.URL != d.FeedURL {
+		return nil, meta
+	}
+	if meta.ETag == "" && meta.LastModified == "" {
+		return nil, meta // Nothing to validate against.
+	}
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, meta
+	}
+	return data, meta
+}
+
+// writeFeedCache saves the feed and then its validators, so validators are
+// never paired with an older copy of the feed.
+func writeFeedCache(dataPath, metaPath string, data []byte, meta feedCacheMeta, mode os.FileMode) error {
+	raw, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.Remove(metaPath)
+	if err := os.WriteFile(dataPath, data, mode); err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, raw, mode)
+}
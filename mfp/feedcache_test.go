@@ -0,0 +1,60 @@
+package mfp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadEpisodesGzippedFeed(t *testing.T) {
+	feed := rss(
+		item("Episode 02: Second", "/02.mp3", 2000, date(2)),
+		item("Episode 01: First", "/01.mp3", 1000, date(1)),
+	)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(strings.ReplaceAll(feed, "SERVER", "http://example.com")))
+	w.Close()
+
+	tests := []struct {
+		name     string
+		encoding string // Content-Encoding header, if any.
+	}{
+		{"compressed file", ""},
+		{"content encoding", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(gz.Bytes())
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(t, srv.URL+"/feed.xml.gz")
+			if err := d.loadEpisodes(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := episodeNumbers(d.Episodes); !slices.Equal(got, []string{"01", "02"}) {
+				t.Errorf("got episodes %v, want [01 02]", got)
+			}
+		})
+	}
+}
+
+func TestGunzipFeed(t *testing.T) {
+	plain := []byte(rss())
+	if got, err := gunzipFeed(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("gunzipFeed changed an uncompressed feed: %q, %v", got, err)
+	}
+	if _, err := gunzipFeed([]byte{0x1f, 0x8b, 0, 0}); err == nil {
+		t.Error("gunzipFeed accepted a broken gzip stream")
+	}
+}
@@ -0,0 +1,104 @@
+package mfp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultNameTemplate produces filenames of the form "XX - Title.mp3".
+const DefaultNameTemplate = "{{.Number}} - {{.Title}}{{.Ext}}"
+
+var defaultNameTemplate = template.Must(template.New("name").Parse(DefaultNameTemplate))
+
+// nameFields are the values available to a filename template.
+type nameFields struct {
+	Number string // Zero-padded episode number.
+	Title  string
+	Year   string // Publication year, empty if unknown.
+	Ext    string // Extension including the dot, e.g. ".mp3".
+}
+
+// ParseNameTemplate parses a text/template filename pattern and renders it
+// once against a sample episode, so mistakes surface at startup rather than
+// halfway through a run.
+func ParseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := nameFields{Number: "01", Title: "Title", Year: "2024", Ext: ".mp3"}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, sample); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return nil, fmt.Errorf("template %q produces an empty filename", text)
+	}
+	return tmpl, nil
+}
+
+// unknownYearDir holds episodes without a published date when ByYear is set.
+const unknownYearDir = "unknown"
+
+// episodePath returns where the episode is stored, relative to OutputDir:
+// the bare filename, or <year>/<filename> when ByYear is set.
+func (d *Downloader) episodePath(ep Episode) string {
+	name := d.episodeFileName(ep)
+	if !d.ByYear {
+		return name
+	}
+	year := unknownYearDir
+	if ep.Published != nil {
+		year = ep.Published.Format("2006")
+	}
+	return filepath.Join(year, name)
+}
+
+// episodeFileName renders the filename template for the episode, with the
+// episode number zero-padded to the width of the highest one in the feed and
+// the extension matching the enclosure format.
+func (d *Downloader) episodeFileName(ep Episode) string {
+	fields := nameFields{
+		Number: ep.Number,
+		Title:  sanitizeFilename(ep.Title),
+		Ext:    ep.Ext,
+	}
+	if n, err := strconv.Atoi(ep.Number); err == nil {
+		fields.Number = fmt.Sprintf("%0*d", d.numberWidth, n)
+	}
+	if fields.Ext == "" {
+		fields.Ext = ".mp3"
+	}
+	if ep.Published != nil {
+		fields.Year = ep.Published.Format("2006")
+	}
+
+	tmpl := d.NameTemplate
+	if tmpl == nil {
+		tmpl = defaultNameTemplate
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		// ParseNameTemplate already rendered it once, so this is unexpected.
+		d.logger().Error("Error rendering filename template, using the default", "episode", ep.Number, "err", err)
+		b.Reset()
+		defaultNameTemplate.Execute(&b, fields)
+	}
+	return sanitizeFilename(b.String())
+}
+
+// sanitizeFilename replaces characters that are reserved on Windows, or that
+// would create subdirectories on Unix, and trims trailing dots and spaces,
+// which Windows silently drops.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimRight(name, ". ")
+}
@@ -0,0 +1,33 @@
+package mfp
+
+import "testing"
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Plain Title", "Plain Title"},
+		{"AC/DC", "AC_DC"},
+		{`Back\Slash`, "Back_Slash"},
+		{"Episode 12: Title", "Episode 12_ Title"},
+		{"../escape", ".._escape"},
+		{`What? "Quoted" <tag> a|b *star*`, "What_ _Quoted_ _tag_ a_b _star_"},
+		{"Trailing dots...", "Trailing dots"},
+		{"Trailing space ", "Trailing space"},
+		{"Tab\there", "Tab_here"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.name); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEpisodeFileNameKeepsTitleInOneFile(t *testing.T) {
+	d := newTestDownloader(t, "")
+	d.numberWidth = 2
+	got := d.episodeFileName(Episode{Number: "7", Title: "Part 1/2: Intro", Ext: ".mp3"})
+	if want := "07 - Part 1_2_ Intro.mp3"; got != want {
+		t.Errorf("episodeFileName = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package mfp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2"
+)
+
+// newTestDownloader returns a Downloader writing to a temporary directory,
+// with logging silenced and no jitter, so retries wait predictably.
+func newTestDownloader(t *testing.T, feedURL string) *Downloader {
+	t.Helper()
+	d := NewDownloader(t.TempDir(), feedURL, "")
+	d.LogOutput = io.Discard
+	d.RetryJitter = 0
+	return d
+}
+
+// rss wraps items in an RSS 2.0 feed.
+func rss(items ...string) string {
+	return `<?xml version="1.0"?><rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel><title>Test Feed</title><itunes:author>Test Artist</itunes:author>` +
+		strings.Join(items, "") + `</channel></rss>`
+}
+
+// item renders a feed item with an audio/mpeg enclosure of the given length
+// at path, served by serveFeed. An empty path leaves the enclosure out.
+func item(title, path string, length int, published time.Time) string {
+	var enclosure string
+	if path != "" {
+		enclosure = fmt.Sprintf(`<enclosure url="SERVER%s" length="%d" type="audio/mpeg"/>`, path, length)
+	}
+	return fmt.Sprintf(`<item><title>%s</title><pubDate>%s</pubDate>%s</item>`, title, published.Format(time.RFC1123Z), enclosure)
+}
+
+// hitCounter counts a test server's requests per path.
+type hitCounter struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (c *hitCounter) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hits[path]++
+}
+
+// get returns how many requests path got.
+func (c *hitCounter) get(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits[path]
+}
+
+// serveFeed serves feed at /feed.xml, with SERVER replaced by the server's
+// URL, and files at their paths, with range support.
+func serveFeed(t *testing.T, feed string, files map[string][]byte) (*httptest.Server, *hitCounter) {
+	t.Helper()
+	hits := &hitCounter{hits: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		if r.URL.Path == "/feed.xml" {
+			w.Header().Set("Content-Type", "application/rss+xml")
+			io.WriteString(w, strings.ReplaceAll(feed, "SERVER", "http://"+r.Host))
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, hits
+}
+
+// fakeMP3 returns size bytes of MPEG audio frame headers followed by zeros,
+// enough for the tagger to take the file for an MP3.
+func fakeMP3(size int) []byte {
+	data := make([]byte, size)
+	for i := 0; i+4 <= size; i += 417 {
+		copy(data[i:], []byte{0xff, 0xfb, 0x90, 0x64})
+	}
+	return data
+}
+
+// taggedMP3 returns fakeMP3(size) behind an ID3v2 tag of its own, with a
+// comment of commentSize bytes, as some podcast hosts ship enclosures.
+func taggedMP3(t *testing.T, size, commentSize int) []byte {
+	t.Helper()
+	path := writeFile(t, t.TempDir(), "enclosure.mp3", fakeMP3(size))
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag.SetTitle("Enclosure title")
+	tag.AddCommentFrame(id3v2.CommentFrame{
+		Encoding: id3v2.EncodingUTF8,
+		Language: "eng",
+		Text:     strings.Repeat("x", commentSize),
+	})
+	if err := tag.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tag.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// date returns midnight UTC of the given day in January 2021.
+func date(day int) time.Time {
+	return time.Date(2021, time.January, day, 0, 0, 0, 0, time.UTC)
+}
+
+// pngImage returns a one-pixel PNG of the given gray level, so tests can
+// tell covers apart.
+func pngImage(t *testing.T, gray uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{Y: gray})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// writeFile writes data to name under dir, creating directories as needed,
+// and returns its path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
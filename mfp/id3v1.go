@@ -0,0 +1,118 @@
+package mfp
+
+import (
+	"io"
+	"os"
+	"strconv"
+)
+
+// id3v1Size is the fixed length of an ID3v1 tag at the end of a file.
+const id3v1Size = 128
+
+// id3v1TagSize returns id3v1Size if the file ends with an ID3v1 tag, or 0.
+func id3v1TagSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return findID3v1(f)
+}
+
+// findID3v1 reports the size of the ID3v1 tag at the end of f, if any.
+func findID3v1(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < id3v1Size {
+		return 0, nil
+	}
+	marker := make([]byte, 3)
+	if _, err := f.ReadAt(marker, info.Size()-id3v1Size); err != nil {
+		return 0, err
+	}
+	if string(marker) != "TAG" {
+		return 0, nil
+	}
+	return id3v1Size, nil
+}
+
+// writeID3v1 writes an ID3v1.1 tag with the episode title, artist, album,
+// year and track number at the end of the file, replacing any existing one.
+// The ID3v2 tag lives at the start of the file, so the two never overlap.
+func writeID3v1(path, album string, ep Episode) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	existing, err := findID3v1(f)
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(-existing, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(id3v1Tag(album, ep), offset)
+	return err
+}
+
+// id3v1Tag encodes an ID3v1.1 tag for the episode.
+func id3v1Tag(album string, ep Episode) []byte {
+	tag := make([]byte, id3v1Size)
+	copy(tag[0:3], "TAG")
+	putLatin1(tag[3:33], ep.Title)
+	putLatin1(tag[33:63], ep.Artist)
+	putLatin1(tag[63:93], album)
+	if ep.Published != nil {
+		putLatin1(tag[93:97], ep.Published.Format("2006"))
+	}
+	// ID3v1.1: a zero byte before the last comment byte marks it as the track.
+	if n, err := strconv.Atoi(ep.Number); err == nil && n > 0 && n < 256 {
+		tag[126] = byte(n)
+	}
+	tag[127] = 255 // No genre.
+	return tag
+}
+
+// putLatin1 copies s into the fixed-size field, replacing characters that
+// ID3v1's Latin-1 encoding can't represent and truncating to fit.
+func putLatin1(field []byte, s string) {
+	i := 0
+	for _, r := range s {
+		if i == len(field) {
+			return
+		}
+		if r > 0xFF {
+			r = '?'
+		}
+		field[i] = byte(r)
+		i++
+	}
+}
+
+// setID3v1Album replaces the album in the file's ID3v1 tag, if it has one.
+func setID3v1Album(path, album string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := findID3v1(f)
+	if err != nil || size == 0 {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	field := make([]byte, 30)
+	putLatin1(field, album)
+	_, err = f.WriteAt(field, info.Size()-id3v1Size+63)
+	return err
+}
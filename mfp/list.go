@@ -0,0 +1,60 @@
+package mfp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Local status of an episode in an EpisodeStatus.
+const (
+	StatusPresent = "present" // Downloaded and tagged.
+	StatusPartial = "partial" // Started, truncated or missing tags.
+	StatusMissing = "missing" // Not downloaded.
+)
+
+// EpisodeStatus pairs a feed episode with the state of its local file.
+type EpisodeStatus struct {
+	Episode
+	Status string
+	File   string // Path relative to the output directory.
+}
+
+// List loads the feed and reports, for every selected episode, whether it is
+// present in the output directory. Nothing is downloaded or written.
+func (d *Downloader) List(ctx context.Context) ([]EpisodeStatus, error) {
+	if err := d.loadEpisodes(ctx); err != nil {
+		return nil, err
+	}
+	state, err := loadState(d.OutputDir, d.Force, d.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	d.state = state
+
+	list := make([]EpisodeStatus, 0, len(d.Episodes))
+	for _, ep := range d.Episodes {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		file := d.episodePath(ep)
+		list = append(list, EpisodeStatus{Episode: ep, Status: d.localStatus(ctx, ep, file), File: file})
+	}
+	return list, nil
+}
+
+// localStatus tells whether the episode's file is complete, partial or
+// missing. A file whose completeness can't be checked counts as partial.
+func (d *Downloader) localStatus(ctx context.Context, ep Episode, file string) string {
+	path := filepath.Join(d.OutputDir, file)
+	if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path + ".part"); err == nil {
+			return StatusPartial
+		}
+		return StatusMissing
+	}
+	if complete, err := d.fileIsComplete(ctx, ep, path); err != nil || !complete {
+		return StatusPartial
+	}
+	return StatusPresent
+}
@@ -0,0 +1,49 @@
+package mfp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockFileName marks an output directory as in use by a run.
+const lockFileName = ".lock"
+
+// ErrLocked is returned when another run holds the output directory's lock.
+var ErrLocked = errors.New("output directory is in use by another run")
+
+// lock creates the lock file, failing with ErrLocked if it already exists,
+// so two runs never write the same temporary and state files. The returned
+// function removes it again.
+func (d *Downloader) lock() (unlock func(), err error) {
+	path := filepath.Join(d.OutputDir, lockFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.fileMode())
+	if errors.Is(err, os.ErrExist) {
+		owner, _ := os.ReadFile(path)
+		return nil, fmt.Errorf("%w (%s); if that run crashed, remove %s or pass -force-unlock",
+			ErrLocked, strings.TrimSpace(string(owner)), path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock output directory: %w", err)
+	}
+	fmt.Fprintf(f, "pid %d, started %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	f.Close()
+	return func() {
+		if err := os.Remove(path); err != nil {
+			d.logger().Warn("Error removing lock file", "err", err)
+		}
+	}, nil
+}
+
+// ForceUnlock removes the lock left behind by a run that didn't exit
+// cleanly. Only call it when no other run is using the output directory.
+func (d *Downloader) ForceUnlock() error {
+	err := os.Remove(filepath.Join(d.OutputDir, lockFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package mfp
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logWriter forwards log output to w. The target can be swapped while the
+// downloader runs, so progress bars can take over the terminal. slog writes
+// each record in a single call, so the mutex also keeps lines from parallel
+// downloads from interleaving.
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// swap points the writer at w and returns the previous target.
+func (l *logWriter) swap(w io.Writer) io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.w
+	l.w = w
+	return prev
+}
+
+// LevelTrace is below slog.LevelDebug and adds per-chunk download detail.
+const LevelTrace = slog.LevelDebug - 4
+
+// logger returns the downloader's logger, building it on first use from
+// LogOutput, LogLevel and JSONLogs.
+func (d *Downloader) logger() *slog.Logger {
+	d.logOnce.Do(func() {
+		out := d.LogOutput
+		if out == nil {
+			out = os.Stderr
+		}
+		d.logOut = &logWriter{w: out}
+		opts := &slog.HandlerOptions{Level: d.LogLevel, ReplaceAttr: nameTraceLevel}
+		if d.JSONLogs {
+			d.log = slog.New(slog.NewJSONHandler(d.logOut, opts))
+		} else {
+			d.log = slog.New(slog.NewTextHandler(d.logOut, opts))
+		}
+	})
+	return d.log
+}
+
+// episodeLogger returns a logger that tags every line with the episode
+// number, so lines from parallel downloads can be told apart.
+func (d *Downloader) episodeLogger(ep Episode) *slog.Logger {
+	return d.logger().With("episode", ep.Number)
+}
+
+// nameTraceLevel prints LevelTrace as "TRACE" rather than "DEBUG-4".
+func nameTraceLevel(groups []string, a slog.Attr) slog.Attr {
+	if level, ok := a.Value.Any().(slog.Level); ok && a.Key == slog.LevelKey && len(groups) == 0 && level == LevelTrace {
+		a.Value = slog.StringValue("TRACE")
+	}
+	return a
+}
@@ -0,0 +1,96 @@
+package mfp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// downloadBuckets are the upper bounds, in seconds, of the download duration
+// histogram.
+var downloadBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+// Metrics collects download counters and serves them in the Prometheus text
+// format. A nil *Metrics records nothing, so it costs nothing when unused.
+type Metrics struct {
+	attempted atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+	bytes     atomic.Int64
+
+	mu      sync.Mutex
+	buckets []int64 // Observations per bucket, not cumulative.
+	count   int64
+	sum     float64
+}
+
+// NewMetrics returns an empty set of metrics, ready to be assigned to
+// Downloader.Metrics and served over HTTP.
+func NewMetrics() *Metrics {
+	return &Metrics{buckets: make([]int64, len(downloadBuckets))}
+}
+
+// downloadStarted counts a download attempt.
+func (m *Metrics) downloadStarted() {
+	if m == nil {
+		return
+	}
+	m.attempted.Add(1)
+}
+
+// downloadFinished records the outcome and duration of a download attempt.
+func (m *Metrics) downloadFinished(ok bool, took time.Duration) {
+	if m == nil {
+		return
+	}
+	if ok {
+		m.succeeded.Add(1)
+	} else {
+		m.failed.Add(1)
+	}
+	seconds := took.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range downloadBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+			break
+		}
+	}
+	m.count++
+	m.sum += seconds
+}
+
+// addBytes counts bytes received from the server.
+func (m *Metrics) addBytes(n int64) {
+	if m == nil {
+		return
+	}
+	m.bytes.Add(n)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("mfp_downloads_attempted_total", "Episode downloads started.", m.attempted.Load())
+	counter("mfp_downloads_succeeded_total", "Episode downloads that completed.", m.succeeded.Load())
+	counter("mfp_downloads_failed_total", "Episode downloads that failed.", m.failed.Load())
+	fmt.Fprintf(w, "# HELP mfp_bytes_transferred Bytes received from the server.\n# TYPE mfp_bytes_transferred gauge\nmfp_bytes_transferred %d\n", m.bytes.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const name = "mfp_download_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken by each episode download.\n# TYPE %s histogram\n", name, name)
+	var cumulative int64
+	for i, bound := range downloadBuckets {
+		cumulative += m.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, m.count, name, m.sum, name, m.count)
+}
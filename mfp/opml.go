@@ -0,0 +1,60 @@
+package mfp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// opml is a minimal OPML 2.0 subscription list.
+type opml struct {
+	XMLName xml.Name  `xml:"opml"`
+	Version string    `xml:"version,attr"`
+	Title   string    `xml:"head>title"`
+	Feeds   []outline `xml:"body>outline"`
+}
+
+// outline is one subscribed feed.
+type outline struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr,omitempty"`
+	XMLURL  string `xml:"xmlUrl,attr"`
+	HTMLURL string `xml:"htmlUrl,attr,omitempty"`
+}
+
+// ExportOPML loads the feed and writes an OPML document subscribing to it
+// to w, for importing into a podcast app.
+func (d *Downloader) ExportOPML(ctx context.Context, w io.Writer) error {
+	if err := d.loadEpisodes(ctx); err != nil {
+		return err
+	}
+	title := d.feed.Title
+	if title == "" {
+		title = d.FeedURL
+	}
+	doc := opml{
+		Version: "2.0",
+		Title:   title,
+		Feeds: []outline{{
+			Type:    "rss",
+			Text:    title,
+			Title:   title,
+			XMLURL:  d.FeedURL,
+			HTMLURL: d.feed.Link,
+		}},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("failed to write OPML: %w", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to write OPML: %w", err)
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return fmt.Errorf("failed to write OPML: %w", err)
+	}
+	return nil
+}
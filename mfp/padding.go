@@ -0,0 +1,115 @@
+package mfp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bogem/id3v2"
+)
+
+// DefaultTagPadding is the space reserved after the ID3v2 tag by default:
+// enough for the text frames to change without moving the audio.
+const DefaultTagPadding = 4 << 10
+
+// saveTag writes tag to the file at path, which it was opened from, and
+// closes it. id3v2's Save copies the whole file to insert the tag, which
+// takes a while for a long episode. Instead, a tag that fits in the space
+// taken by the old one, padding included, is overwritten in place. Otherwise
+// the file is rewritten once, reserving d.TagPadding bytes of padding so the
+// next retag fits.
+func (d *Downloader) saveTag(tag *id3v2.Tag, path string) error {
+	var buf bytes.Buffer
+	_, err := tag.WriteTo(&buf)
+	tag.Close()
+	if err != nil {
+		return err
+	}
+	if buf.Len() == 0 {
+		return nil // No frames, so no tag to write.
+	}
+	existing, err := id3v2TagSize(path)
+	if err != nil {
+		return err
+	}
+	if spare := existing - int64(buf.Len()); existing > 0 && (spare == 0 || spare >= minPadding) {
+		return writeTagInPlace(path, buf.Bytes(), existing)
+	}
+	padding := d.TagPadding
+	if padding > 0 {
+		padding = max(padding, minPadding)
+	}
+	return rewriteWithTag(path, buf.Bytes(), existing, padding)
+}
+
+// minPadding is the smallest padding id3v2 can parse: it reads padding as a
+// frame header and only recognizes it as blank if the whole header fits.
+const minPadding = 10
+
+// writeTagInPlace overwrites the first size bytes of the file with the
+// encoded tag, turning the remainder into padding. The caller makes sure
+// the padding is empty or at least minPadding long.
+func writeTagInPlace(path string, encoded []byte, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, size)
+	copy(block, encoded)
+	putTagSize(block, size-10)
+	if _, err := f.WriteAt(block, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewriteWithTag replaces the first oldSize bytes of the file, the old tag if
+// any, with the encoded tag followed by padding zero bytes. It goes through
+// a temporary file so an interrupted rewrite leaves the original intact.
+func rewriteWithTag(path string, encoded []byte, oldSize, padding int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(oldSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := path + ".tagtmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // No-op once renamed.
+	block := make([]byte, int64(len(encoded))+padding)
+	copy(block, encoded)
+	putTagSize(block, int64(len(block))-10)
+	_, err = dst.Write(block)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rewrite tag: %w", err)
+	}
+	src.Close()
+	return os.Rename(tmp, path)
+}
+
+// putTagSize stores size, which excludes the 10-byte header, in the
+// synchsafe size field of the ID3v2 header at the start of block.
+func putTagSize(block []byte, size int64) {
+	block[6] = byte(size >> 21 & 0x7f)
+	block[7] = byte(size >> 14 & 0x7f)
+	block[8] = byte(size >> 7 & 0x7f)
+	block[9] = byte(size & 0x7f)
+}
@@ -0,0 +1,184 @@
+package mfp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// action is what a run does with an episode.
+type action int
+
+const (
+	actionSkip       action = iota // Downloaded and tagged already.
+	actionRetag                    // Audio is intact, the tags need updating.
+	actionResume                   // A partial download is left over.
+	actionDownload                 // Nothing on disk yet.
+	actionRedownload               // The file on disk has the wrong size.
+)
+
+func (a action) String() string {
+	switch a {
+	case actionSkip:
+		return "skip"
+	case actionRetag:
+		return "retag"
+	case actionResume:
+		return "resume"
+	case actionDownload:
+		return "download"
+	case actionRedownload:
+		return "redownload"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// downloads reports whether the action fetches the episode's audio.
+func (a action) downloads() bool {
+	return a == actionResume || a == actionDownload || a == actionRedownload
+}
+
+// planStep is the action decided for one episode.
+type planStep struct {
+	ep       Episode
+	fileName string // Relative to OutputDir.
+	path     string
+	action   action
+}
+
+// plan decides what to do with every episode from what is on disk, before
+// anything is changed, and logs the totals. Running the same plan again
+// after a crash picks up where it stopped: complete episodes are skipped and
+// partial downloads resumed.
+func (d *Downloader) plan(ctx context.Context) ([]planStep, error) {
+	steps := make([]planStep, 0, len(d.Episodes))
+	counts := make(map[action]int)
+	for _, ep := range d.Episodes {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		step := d.planEpisode(ctx, ep)
+		d.episodeLogger(ep).Debug("Planned episode", "file", step.fileName, "action", step.action)
+		counts[step.action]++
+		steps = append(steps, step)
+	}
+	d.logger().Info("Plan ready",
+		"skip", counts[actionSkip],
+		"retag", counts[actionRetag],
+		"resume", counts[actionResume],
+		"download", counts[actionDownload],
+		"redownload", counts[actionRedownload],
+	)
+	logCatalogSize(d.logger(), steps)
+	return steps, nil
+}
+
+// logCatalogSize reports how big the selected episodes are together and how
+// much of that still has to be downloaded. Episodes whose size the feed
+// doesn't give make the totals lower bounds.
+func logCatalogSize(log *slog.Logger, steps []planStep) {
+	var total, remaining int64
+	var totalUnknown, remainingUnknown bool
+	for _, step := range steps {
+		size := step.ep.ExpectedSize
+		if size <= 0 {
+			totalUnknown = true
+			remainingUnknown = remainingUnknown || step.action.downloads()
+			continue
+		}
+		total += size
+		if step.action.downloads() {
+			remaining += size
+		}
+	}
+	log.Info("Catalog size",
+		"total", sizeLabel(total, totalUnknown),
+		"to_download", sizeLabel(remaining, remainingUnknown),
+	)
+}
+
+// checkRemoteSize replaces the episode's expected size with the one the
+// server reports now, and reports whether it changed since the file on disk
+// was downloaded, e.g. because the episode was re-encoded. That is judged by
+// the size recorded in the state file, or else by the feed's.
+func (d *Downloader) checkRemoteSize(ctx context.Context, ep Episode, fileName string) (Episode, bool) {
+	log := d.episodeLogger(ep)
+	size, err := d.remoteSize(ctx, ep)
+	if err != nil {
+		log.Warn("Error checking remote size", "file", fileName, "err", err)
+		return ep, false
+	}
+	if size == 0 {
+		return ep, false
+	}
+	previous := ep.ExpectedSize
+	if d.state != nil {
+		if n := d.state.downloaded(ep); n > 0 {
+			previous = n
+		}
+	}
+	ep.ExpectedSize = size
+	if previous <= 0 || previous == size {
+		return ep, false
+	}
+	log.Info("Remote size changed, downloading the episode again", "file", fileName, "was", previous, "now", size)
+	return ep, true
+}
+
+// sizeLabel formats a byte total, as a lower bound if some sizes are unknown.
+func sizeLabel(n int64, partial bool) string {
+	if partial {
+		return "at least " + formatSize(n)
+	}
+	return formatSize(n)
+}
+
+// planEpisode decides the action for one episode.
+func (d *Downloader) planEpisode(ctx context.Context, ep Episode) planStep {
+	fileName := d.episodePath(ep)
+	step := planStep{ep: ep, fileName: fileName, path: filepath.Join(d.OutputDir, fileName)}
+
+	if d.Sink != nil {
+		// Streamed episodes leave nothing on disk to check.
+		step.action = actionDownload
+		if d.state != nil && d.state.stored(ep, step.path) {
+			step.action = actionSkip
+		}
+		return step
+	}
+
+	if _, err := os.Stat(step.path); err != nil {
+		// Same condition downloadFile uses to pick up a partial download.
+		info, err := os.Stat(step.path + ".part")
+		if err == nil && ep.ExpectedSize > 0 && info.Size() < ep.ExpectedSize {
+			step.action = actionResume
+		} else {
+			step.action = actionDownload
+		}
+		return step
+	}
+
+	if d.CheckRemoteSize {
+		var changed bool
+		ep, changed = d.checkRemoteSize(ctx, ep, fileName)
+		step.ep = ep
+		if changed {
+			step.action = actionRedownload
+			return step
+		}
+	}
+	complete, err := d.fileIsComplete(ctx, ep, step.path)
+	if err != nil {
+		d.episodeLogger(ep).Error("Error checking episode", "file", fileName, "err", err)
+	}
+	if complete {
+		step.action = actionSkip
+	} else if sizeOk, _ := d.sizeMatches(ctx, ep, step.path); sizeOk {
+		step.action = actionRetag
+	} else {
+		step.action = actionRedownload
+	}
+	return step
+}
@@ -0,0 +1,47 @@
+package mfp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	const size = 10000
+	d := newTestDownloader(t, "")
+	d.numberWidth = 2
+	cover := writeFile(t, d.OutputDir, "cover.png", pngImage(t, 0))
+	episode := func(number string) Episode {
+		return Episode{Number: number, Title: "Episode " + number, Ext: ".mp3", ExpectedSize: size}
+	}
+	d.Episodes = []Episode{episode("1"), episode("2"), episode("3"), episode("4"), episode("5")}
+
+	// 1 is downloaded and tagged.
+	present := writeFile(t, d.OutputDir, d.episodePath(d.Episodes[0]), fakeMP3(size))
+	if err := d.tagEpisode(present, cover, d.Episodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	// 2 has all its audio but no tags.
+	writeFile(t, d.OutputDir, d.episodePath(d.Episodes[1]), fakeMP3(size))
+	// 3 was cut off by a crash.
+	writeFile(t, d.OutputDir, d.episodePath(d.Episodes[2])+".part", fakeMP3(size/2))
+	// 4 is truncated.
+	writeFile(t, d.OutputDir, d.episodePath(d.Episodes[3]), fakeMP3(size/2))
+	// 5 is missing.
+
+	steps, err := d.plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []action{actionSkip, actionRetag, actionResume, actionRedownload, actionDownload}
+	if len(steps) != len(want) {
+		t.Fatalf("got %d steps, want %d", len(steps), len(want))
+	}
+	for i, step := range steps {
+		if step.action != want[i] {
+			t.Errorf("episode %s planned %s, want %s", step.ep.Number, step.action, want[i])
+		}
+		if step.fileName != d.episodePath(d.Episodes[i]) {
+			t.Errorf("episode %s planned for %q, want %q", step.ep.Number, step.fileName, d.episodePath(d.Episodes[i]))
+		}
+	}
+}
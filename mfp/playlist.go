@@ -0,0 +1,39 @@
+package mfp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// generatePlaylist writes playlist.m3u8 into the output directory, listing
+// the episodes present on disk in download order.
+func (d *Downloader) generatePlaylist() error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	count := 0
+	for _, ep := range d.Episodes {
+		fileName := d.episodePath(ep)
+		if _, err := os.Stat(filepath.Join(d.OutputDir, fileName)); err != nil {
+			continue
+		}
+		// The duration is in whole seconds, -1 if unknown. Paths are
+		// relative to the playlist and use forward slashes, which every
+		// player understands.
+		duration := -1
+		if ep.Duration > 0 {
+			duration = int(ep.Duration.Round(time.Second).Seconds())
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n%s\n", duration, ep.Number, ep.Title, filepath.ToSlash(fileName))
+		count++
+	}
+
+	playlistPath := filepath.Join(d.OutputDir, "playlist.m3u8")
+	if err := os.WriteFile(playlistPath, []byte(b.String()), d.fileMode()); err != nil {
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	d.logger().Info("Playlist written", "episodes", count)
+	return nil
+}
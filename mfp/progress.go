@@ -0,0 +1,167 @@
+package mfp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressRenderer draws one progress bar per active download at the bottom
+// of the terminal and redraws them in place. It also serves as the log output
+// while downloads run, so log lines are printed above the bars instead of
+// being interleaved with them.
+type progressRenderer struct {
+	mu    sync.Mutex
+	out   io.Writer
+	bars  []*progressBar
+	lines int // Number of bar lines currently drawn.
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newProgressRenderer starts a renderer that refreshes the bars on out.
+func newProgressRenderer(out io.Writer) *progressRenderer {
+	r := &progressRenderer{
+		out:  out,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go r.refresh()
+	return r
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// add registers a new bar for a download of total bytes, starting at current.
+func (r *progressRenderer) add(label string, current, total int64) *progressBar {
+	bar := &progressBar{label: label, total: total, start: current, started: time.Now()}
+	bar.current.Store(current)
+
+	r.mu.Lock()
+	r.bars = append(r.bars, bar)
+	r.mu.Unlock()
+	return bar
+}
+
+// remove stops drawing bar.
+func (r *progressRenderer) remove(bar *progressBar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, b := range r.bars {
+		if b == bar {
+			r.bars = append(r.bars[:i], r.bars[i+1:]...)
+			break
+		}
+	}
+	r.clear()
+	r.draw()
+}
+
+// Write prints p above the bars.
+func (r *progressRenderer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clear()
+	n, err := r.out.Write(p)
+	r.draw()
+	return n, err
+}
+
+// Close stops refreshing and erases the bars.
+func (r *progressRenderer) Close() error {
+	close(r.stop)
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clear()
+	return nil
+}
+
+func (r *progressRenderer) refresh() {
+	defer close(r.done)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			r.clear()
+			r.draw()
+			r.mu.Unlock()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// clear erases the bar lines drawn last time. r.mu must be held.
+func (r *progressRenderer) clear() {
+	if r.lines > 0 {
+		fmt.Fprintf(r.out, "\033[%dA\033[J", r.lines)
+		r.lines = 0
+	}
+}
+
+// draw prints the current state of every bar. r.mu must be held.
+func (r *progressRenderer) draw() {
+	for _, bar := range r.bars {
+		fmt.Fprintf(r.out, "\r%s\n", bar)
+	}
+	r.lines = len(r.bars)
+}
+
+// barWidth is the number of cells in a progress bar.
+const barWidth = 30
+
+// progressBar is the progress of one download, drawn by progressRenderer.
+type progressBar struct {
+	label   string
+	total   int64 // 0 if unknown.
+	start   int64 // Bytes already on disk when the download started.
+	current atomic.Int64
+	started time.Time
+}
+
+// proxyReader returns a reader that advances the bar as r is read.
+func (b *progressBar) proxyReader(r io.Reader) io.Reader {
+	return &barReader{r: r, bar: b}
+}
+
+// String renders the bar as "label [###...] received / total pct speed".
+func (b *progressBar) String() string {
+	n := b.current.Load()
+	var speed int64
+	if elapsed := time.Since(b.started).Seconds(); elapsed > 0 {
+		speed = int64(float64(n-b.start) / elapsed)
+	}
+	filled := 0
+	if b.total > 0 {
+		filled = int(min(n, b.total) * barWidth / b.total)
+	}
+	bar := "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "]"
+	if b.total <= 0 {
+		return fmt.Sprintf("%s %s %s %s/s", b.label, bar, formatSize(n), formatSize(speed))
+	}
+	return fmt.Sprintf("%s %s %s / %s %3d%% %s/s", b.label, bar, formatSize(n), formatSize(b.total),
+		min(n, b.total)*100/b.total, formatSize(speed))
+}
+
+// barReader counts the bytes read through it on a progressBar.
+type barReader struct {
+	r   io.Reader
+	bar *progressBar
+}
+
+func (r *barReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.bar.current.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,123 @@
+package mfp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every download, so that their
+// combined throughput stays under the limit rather than each one's.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second.
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows bytesPerSec bytes per second, with bursts of up to
+// one second worth of data.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// burst is the largest read a single wait may cover.
+func (l *rateLimiter) burst() int {
+	return max(int(l.rate), 1)
+}
+
+// wait takes n bytes from the bucket, blocking until the bucket has refilled
+// enough to pay for them.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than its limiter allows.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if b := t.limiter.burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ParseSize parses a byte count such as "500k", "2m" or "1g". Suffixes are
+// binary multiples and case-insensitive; a bare number is taken as bytes.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "b")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(str, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(str, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(str, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatSize renders a byte count in the largest binary unit that keeps it
+// at least 1, e.g. "1.5 GB".
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,82 @@
+package mfp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// resumeAll finds the partial downloads that crashed runs left anywhere in
+// OutputDir and moves their episodes to the front of d.Episodes, so they are
+// finished before anything else is downloaded. Episodes the filters left out
+// are added back for that. Partial files that match no feed episode are only
+// reported; Orphans lists them too.
+func (d *Downloader) resumeAll(ctx context.Context) error {
+	byName := make(map[string]Episode, len(d.feedEpisodes))
+	for _, ep := range d.feedEpisodes {
+		byName[d.episodePath(ep)] = ep
+	}
+
+	var partial []Episode
+	err := filepath.WalkDir(d.OutputDir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == d.OutputDir {
+			return filepath.SkipAll // Nothing downloaded yet.
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, ".part") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		ep, ok := byName[strings.TrimSuffix(rel, ".part")]
+		if !ok {
+			d.logger().Warn("Partial download matches no episode in the feed, remove it with -clean", "file", rel)
+			return nil
+		}
+		partial = append(partial, ep)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan the output directory: %w", err)
+	}
+	if len(partial) == 0 {
+		return nil
+	}
+
+	// Keep the selected order among the partial episodes, and put the ones
+	// the filters left out after them.
+	rank := func(ep Episode) int {
+		i := slices.IndexFunc(d.Episodes, func(e Episode) bool { return e.Number == ep.Number })
+		if i < 0 {
+			return len(d.Episodes)
+		}
+		return i
+	}
+	slices.SortStableFunc(partial, func(a, b Episode) int { return rank(a) - rank(b) })
+	added := 0
+	for _, ep := range partial {
+		if rank(ep) == len(d.Episodes) {
+			added++
+		}
+	}
+	episodes := slices.Clone(partial)
+	for _, ep := range d.Episodes {
+		if !slices.ContainsFunc(partial, func(e Episode) bool { return e.Number == ep.Number }) {
+			episodes = append(episodes, ep)
+		}
+	}
+	d.Episodes = episodes
+	d.logger().Info("Resuming partial downloads first", "episodes", len(partial), "added", added)
+	return nil
+}
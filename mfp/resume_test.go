@@ -0,0 +1,54 @@
+package mfp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeAll(t *testing.T) {
+	first, second := fakeMP3(20000), fakeMP3(5000)
+	srv, _ := serveFeed(t, rss(
+		item("Episode 01: First", "/01.mp3", len(first), date(1)),
+		item("Episode 02: Second", "/02.mp3", len(second), date(2)),
+	), map[string][]byte{
+		"/01.mp3": first,
+		"/02.mp3": second,
+	})
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	d.NoCover = true
+	d.ResumeAll = true
+	// Episode 1 is left out of the selection but has a partial download.
+	d.Select = func(episodes []Episode) ([]Episode, error) {
+		return episodes[1:], nil
+	}
+	const partial = 12000
+	part := writeFile(t, d.OutputDir, "01 - First.mp3.part", first[:partial])
+	orphan := writeFile(t, d.OutputDir, "99 - Gone.mp3.part", []byte("left over"))
+
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.stats.bytes.Load(), int64(len(first)-partial+len(second)); got != want {
+		t.Errorf("received %d bytes, want %d: only the rest of episode 1", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(d.OutputDir, "01 - First.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio := data[tagSizeFromHeader(data):]; !bytes.Equal(audio, first) {
+		t.Errorf("resumed episode has %d bytes of audio, want the enclosure's %d", len(audio), len(first))
+	}
+	if _, err := os.Stat(part); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.OutputDir, "02 - Second.mp3")); err != nil {
+		t.Errorf("selected episode wasn't downloaded: %v", err)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("orphaned partial file was touched: %v", err)
+	}
+}
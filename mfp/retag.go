@@ -0,0 +1,100 @@
+package mfp
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bogem/id3v2"
+)
+
+// RetagAlbum renames the album of every MP3 in the output directory tagged
+// with oldAlbum to the configured album (see Album), e.g. to fix a typo in an
+// earlier -album. Other tags, the cover included, are kept as they are and
+// so is the file time. It doesn't need the feed.
+func (d *Downloader) RetagAlbum(ctx context.Context, oldAlbum string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sums, err := loadChecksums(d.OutputDir, d.fileMode())
+	if err != nil {
+		return err
+	}
+	d.sums = sums
+
+	log := d.logger()
+	album := d.album()
+	checked, updated, skipped, failed := 0, 0, 0, 0
+	err = filepath.WalkDir(d.OutputDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(path), ".mp3") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		checked++
+		changed, err := d.retagAlbum(path, oldAlbum, album)
+		switch {
+		case err != nil:
+			log.Error("Error updating album", "file", rel, "err", err)
+			failed++
+		case changed:
+			log.Info("Album updated", "file", rel)
+			d.recordChecksum(rel, nil)
+			updated++
+		default:
+			log.Debug("Album left as is", "file", rel)
+			skipped++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan the output directory: %w", err)
+	}
+	log.Info("Album update finished", "checked", checked, "updated", updated, "skipped", skipped, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d files could not be updated", ErrEpisodesFailed, failed, checked)
+	}
+	return nil
+}
+
+// retagAlbum sets the album of the MP3 at path to album if it is currently
+// oldAlbum, and reports whether it did.
+func (d *Downloader) retagAlbum(path, oldAlbum, album string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		return false, err
+	}
+	defer tag.Close()
+	if tag.Album() != oldAlbum || oldAlbum == album {
+		return false, nil
+	}
+	tag.SetAlbum(album)
+	if err := d.saveTag(tag, path); err != nil {
+		return false, err
+	}
+	if err := setID3v1Album(path, album); err != nil {
+		return false, err
+	}
+	// Saving the tags reset the file time.
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		d.logger().Warn("Error setting file time", "file", path, "err", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package mfp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter is the longest Retry-After wait honored. A server asking for
+// more is taken to mean "not today", and its response is returned as-is.
+const maxRetryAfter = 5 * time.Minute
+
+// retryable reports whether a response is worth retrying: a 5xx error, or a
+// 429 Too Many Requests.
+func retryable(resp *http.Response) bool {
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// Errors a second attempt at the same request would run into again.
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+	errNoCertificate    = errors.New("server sent no certificate")
+)
+
+// permanent reports whether a request error can't go away on a retry, such
+// as hitting the redirect cap or a certificate that doesn't verify.
+func permanent(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+	)
+	return errors.Is(err, errTooManyRedirects) || errors.Is(err, errNoCertificate) ||
+		errors.As(err, &unknownAuthority) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid) || errors.As(err, &verification)
+}
+
+// retryAfter returns the wait the response's Retry-After header asks for,
+// given in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// fitsDeadline reports whether ctx leaves time to wait before another
+// attempt.
+func fitsDeadline(ctx context.Context, wait time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > wait
+}
+
+// attemptTimeout is a timeout on one attempt at a request, which
+// getWithRetry stops while it waits for the next one.
+type attemptTimeout struct {
+	timer   *time.Timer
+	timeout time.Duration
+	parent  *attemptTimeout
+}
+
+type attemptTimeoutKey struct{}
+
+// withAttemptTimeout returns ctx carrying timer, which cancels it once
+// timeout passes, for pauseTimeouts to find.
+func withAttemptTimeout(ctx context.Context, timer *time.Timer, timeout time.Duration) context.Context {
+	parent, _ := ctx.Value(attemptTimeoutKey{}).(*attemptTimeout)
+	return context.WithValue(ctx, attemptTimeoutKey{}, &attemptTimeout{timer: timer, timeout: timeout, parent: parent})
+}
+
+// pauseTimeouts stops the attempt timeouts in ctx that haven't fired and
+// returns a function starting them over with their full timeout.
+func pauseTimeouts(ctx context.Context) (restart func()) {
+	var stopped []*attemptTimeout
+	for t, _ := ctx.Value(attemptTimeoutKey{}).(*attemptTimeout); t != nil; t = t.parent {
+		if t.timer.Stop() {
+			stopped = append(stopped, t)
+		}
+	}
+	return func() {
+		for _, t := range stopped {
+			t.timer.Reset(t.timeout)
+		}
+	}
+}
+
+// jitter spreads delay randomly by up to d.RetryJitter of it either way, so
+// workers that failed together don't all retry at the same moment.
+func (d *Downloader) jitter(delay time.Duration) time.Duration {
+	if d.RetryJitter <= 0 {
+		return delay
+	}
+	spread := float64(delay) * min(d.RetryJitter, 1)
+	return delay + time.Duration((rand.Float64()*2-1)*spread)
+}
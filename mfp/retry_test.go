@@ -0,0 +1,140 @@
+package mfp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetWithRetryStopsAtRedirectCap(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	d.MaxRedirects = 2
+	d.Retries = 3
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.getWithRetry(req)
+	if !errors.Is(err, errTooManyRedirects) {
+		t.Fatalf("getWithRetry error = %v, want %v", err, errTooManyRedirects)
+	}
+	// One request plus two redirects, and no retries.
+	if got := requests.Load(); got != 3 {
+		t.Errorf("server got %d requests, want 3", got)
+	}
+}
+
+func TestRetryAfterDoesNotCountAgainstTimeout(t *testing.T) {
+	audio := fakeMP3(5000)
+	var feedHits, audioHits atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits := &audioHits
+		if r.URL.Path == "/feed.xml" {
+			hits = &feedHits
+		}
+		// Both the feed and the episode are rate limited at first, for
+		// longer than the timeout.
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Path == "/feed.xml" {
+			io.WriteString(w, strings.ReplaceAll(rss(item("Episode 01: First", "/01.mp3", len(audio), date(1))), "SERVER", srv.URL))
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write(audio)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	d.NoCover = true
+	d.Retries = 1
+	d.Timeout = 500 * time.Millisecond
+	started := time.Now()
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 2*time.Second {
+		t.Errorf("run took %s, want the two Retry-After waits of a second", elapsed)
+	}
+	if feedHits.Load() != 2 || audioHits.Load() != 2 {
+		t.Errorf("server got %d feed and %d episode requests, want 2 and 2", feedHits.Load(), audioHits.Load())
+	}
+}
+
+func TestRetryAfterPastDeadline(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	d.Retries = 3
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	resp, err := d.getWithRetry(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %s, want the server's 503", resp.Status)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("getWithRetry took %s, want it to give up without waiting", elapsed)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("server got %d requests, want 1", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		got, ok := retryAfter(resp, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
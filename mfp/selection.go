@@ -0,0 +1,75 @@
+package mfp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSelection returns the episodes picked by sel, a comma-separated list
+// of episode numbers and inclusive ranges such as "1-5,10,12-14", or "all".
+// Every number and range must match at least one of the episodes. The result
+// keeps the order of episodes.
+func ParseSelection(sel string, episodes []Episode) ([]Episode, error) {
+	sel = strings.TrimSpace(sel)
+	if strings.EqualFold(sel, "all") {
+		return episodes, nil
+	}
+	available := make(map[int]bool, len(episodes))
+	for _, ep := range episodes {
+		if n, err := strconv.Atoi(ep.Number); err == nil {
+			available[n] = true
+		}
+	}
+
+	chosen := make(map[int]bool)
+	for _, part := range strings.Split(sel, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, err := parseRange(part)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		// Walk the episodes rather than the range, which can be huge.
+		for n := range available {
+			if lo <= n && n <= hi {
+				chosen[n] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no episode matches %q", part)
+		}
+	}
+	if len(chosen) == 0 {
+		return nil, fmt.Errorf("no episodes selected")
+	}
+
+	var picked []Episode
+	for _, ep := range episodes {
+		if n, err := strconv.Atoi(ep.Number); err == nil && chosen[n] {
+			picked = append(picked, ep)
+		}
+	}
+	return picked, nil
+}
+
+// parseRange parses "7" or "3-9" into its inclusive bounds.
+func parseRange(s string) (lo, hi int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err = strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || lo < 0 {
+		return 0, 0, fmt.Errorf("invalid episode number in %q", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	hi, err = strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("invalid episode range %q", s)
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,41 @@
+package mfp
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	episodes := []Episode{{Number: "01"}, {Number: "2"}, {Number: "3"}, {Number: "10"}, {Number: "Special"}}
+	tests := []struct {
+		sel     string
+		want    []string
+		wantErr bool
+	}{
+		{"all", []string{"01", "2", "3", "10", "Special"}, false},
+		{"1, 3", []string{"01", "3"}, false},
+		{"2-3,10", []string{"2", "3", "10"}, false},
+		{"1-2000000000", []string{"01", "2", "3", "10"}, false},
+		{fmt.Sprintf("3-%d", math.MaxInt), []string{"3", "10"}, false},
+		{"4-9", nil, true},
+		{"3-1", nil, true},
+		{"x", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		picked, err := ParseSelection(tt.sel, episodes)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSelection(%q) error = %v, want error %v", tt.sel, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, ep := range picked {
+			got = append(got, ep.Number)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSelection(%q) = %v, want %v", tt.sel, got, tt.want)
+		}
+	}
+}
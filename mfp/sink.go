@@ -0,0 +1,119 @@
+package mfp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sink is where downloaded episodes are written. Downloader.Sink defaults to
+// a FileSink on the output directory; another one, e.g. for object storage,
+// receives the episodes instead.
+type Sink interface {
+	// Create returns the writer for the episode's file, name being its path
+	// relative to the output directory. The episode only counts as stored
+	// once Close returns nil. If the download fails partway, the writer is
+	// aborted if it implements Aborter, and closed otherwise.
+	Create(ctx context.Context, ep Episode, name string) (io.WriteCloser, error)
+}
+
+// Aborter is implemented by sink writers that can discard what was written
+// to them, so a failed download leaves nothing behind.
+type Aborter interface {
+	Abort() error
+}
+
+// FileSink is a Sink storing episodes under Dir, with the same layout as
+// the output directory. It is the only Sink that resumes an interrupted
+// download, from the ".part" file it leaves next to the episode.
+type FileSink struct {
+	Dir string
+	// DirMode and FileMode are the permissions of created directories and
+	// files, before the umask; zero uses DefaultDirMode and DefaultFileMode.
+	DirMode, FileMode os.FileMode
+}
+
+// Create implements Sink. The file is written under a temporary name and
+// renamed into place by Close, so Dir never holds a half-written episode.
+func (s FileSink) Create(ctx context.Context, ep Episode, name string) (io.WriteCloser, error) {
+	f, err := s.open(name, os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// resume reopens the partial file an interrupted download of name left, for
+// appending. It returns nil if there is none.
+func (s FileSink) resume(name string) (*sinkFile, error) {
+	f, err := s.open(name, os.O_APPEND)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// discard removes the partial file of name, if any.
+func (s FileSink) discard(name string) {
+	os.Remove(filepath.Join(s.Dir, name) + ".part")
+}
+
+// open opens the partial file of name with the extra flag, O_TRUNC creating
+// it if needed.
+func (s FileSink) open(name string, flag int) (*sinkFile, error) {
+	dest := filepath.Join(s.Dir, name)
+	dirMode, fileMode := s.DirMode, s.FileMode
+	if dirMode == 0 {
+		dirMode = DefaultDirMode
+	}
+	if fileMode == 0 {
+		fileMode = DefaultFileMode
+	}
+	if flag == os.O_TRUNC {
+		if err := os.MkdirAll(filepath.Dir(dest), dirMode); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(dest+".part", os.O_RDWR|flag, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	return &sinkFile{File: f, dest: dest}, nil
+}
+
+// sinkFile renames itself to dest when closed.
+type sinkFile struct {
+	*os.File
+	dest string
+}
+
+func (f *sinkFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.dest)
+}
+
+// Abort implements Aborter by removing the temporary file.
+func (f *sinkFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// keep closes the temporary file without renaming it, so the next attempt
+// can resume it.
+func (f *sinkFile) keep() error {
+	return f.File.Close()
+}
+
+// sink returns d.Sink, or a FileSink on OutputDir if it isn't set.
+func (d *Downloader) sink() Sink {
+	if d.Sink != nil {
+		return d.Sink
+	}
+	return FileSink{Dir: d.OutputDir, DirMode: d.dirMode(), FileMode: d.fileMode()}
+}
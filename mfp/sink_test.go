@@ -0,0 +1,132 @@
+package mfp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bogem/id3v2"
+)
+
+// memSink is a Sink keeping episodes in memory.
+type memSink struct {
+	mu      sync.Mutex
+	files   map[string][]byte
+	created int
+	aborted int
+}
+
+func (s *memSink) Create(ctx context.Context, ep Episode, name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.created++
+	return &memFile{sink: s, name: name}, nil
+}
+
+type memFile struct {
+	bytes.Buffer
+	sink *memSink
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.sink.mu.Lock()
+	defer f.sink.mu.Unlock()
+	if f.sink.files == nil {
+		f.sink.files = make(map[string][]byte)
+	}
+	f.sink.files[f.name] = f.Bytes()
+	return nil
+}
+
+func (f *memFile) Abort() error {
+	f.sink.mu.Lock()
+	defer f.sink.mu.Unlock()
+	f.sink.aborted++
+	return nil
+}
+
+func TestSinkStreamsTaggedEpisode(t *testing.T) {
+	audio := fakeMP3(10000)
+	oldV1 := make([]byte, id3v1Size)
+	copy(oldV1, "TAGEnclosure title")
+	enclosure := append(taggedMP3(t, len(audio), 100), oldV1...)
+	srv, hits := serveFeed(t, rss(item("Episode 01: First", "/01.mp3", len(enclosure), date(1))), map[string][]byte{
+		"/01.mp3": enclosure,
+	})
+	sink := &memSink{}
+	newDownloader := func(dir string) *Downloader {
+		d := newTestDownloader(t, srv.URL+"/feed.xml")
+		d.OutputDir = dir
+		d.NoCover = true
+		d.ID3v1 = true
+		d.Sink = sink
+		return d
+	}
+	dir := t.TempDir()
+	ctx := context.Background()
+	d := newDownloader(dir)
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	name := d.episodePath(d.Episodes[0])
+	if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("episode was written to the output directory too: %v", err)
+	}
+	data, ok := sink.files[name]
+	if !ok {
+		t.Fatalf("sink has no %s, got %d files", name, len(sink.files))
+	}
+	tag, err := id3v2.ParseReader(bytes.NewReader(data), id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tag.Title(); got != "First" {
+		t.Errorf("title = %q, want First", got)
+	}
+	tagSize := tagSizeFromHeader(data)
+	if got := data[tagSize : len(data)-id3v1Size]; !bytes.Equal(got, audio) {
+		t.Errorf("stored audio is %d bytes, want the enclosure's %d without its tags", len(got), len(audio))
+	}
+	if v1 := data[len(data)-id3v1Size:]; !bytes.HasPrefix(v1, []byte("TAGFirst\x00")) {
+		t.Errorf("ID3v1 tag starts with %q, want the episode title", v1[:12])
+	}
+
+	// The state remembers the stored episode.
+	d = newDownloader(dir)
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sink.created != 1 || hits.get("/01.mp3") != 1 {
+		t.Errorf("second run: %d sink files created, %d enclosure requests, want 1 and 1", sink.created, hits.get("/01.mp3"))
+	}
+}
+
+func TestSinkAbortsFailedEpisode(t *testing.T) {
+	page := []byte("<html>Not found</html>")
+	srv, _ := serveFeed(t, rss(item("Episode 01: First", "/01.mp3", len(page), date(1))), map[string][]byte{
+		"/01.mp3": page,
+	})
+	sink := &memSink{}
+	d := newTestDownloader(t, srv.URL+"/feed.xml")
+	d.NoCover = true
+	d.Retries = 2
+	d.Sink = sink
+	if err := d.Run(context.Background()); !errors.Is(err, ErrEpisodesFailed) {
+		t.Fatalf("Run = %v, want ErrEpisodesFailed", err)
+	}
+	if len(sink.files) != 0 {
+		t.Errorf("sink stored %d files, want none", len(sink.files))
+	}
+	// The episode's retry pass tries again, but a download that isn't
+	// audio isn't retried on its own.
+	if sink.aborted != 2 || sink.created != 2 {
+		t.Errorf("sink: %d created, %d aborted, want 2 and 2", sink.created, sink.aborted)
+	}
+}
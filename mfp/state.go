@@ -0,0 +1,190 @@
+package mfp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateFileName is the checkpoint file kept in the output directory.
+const stateFileName = ".state.json"
+
+// downloadState records which episodes were fully downloaded and tagged so
+// later runs can skip them without re-reading their tags or asking the server.
+type downloadState struct {
+	mu       sync.Mutex
+	path     string
+	mode     os.FileMode           // Permissions of a new state file.
+	ignore   bool                  // Entries only serve for their sizes; see loadState.
+	Episodes map[string]stateEntry `json:"episodes"` // Keyed by episode number.
+}
+
+// stateEntry describes a completed episode.
+type stateEntry struct {
+	File       string `json:"file"`
+	Size       int64  `json:"size"`                 // File size after tagging.
+	Downloaded int64  `json:"downloaded,omitempty"` // Bytes received before tagging.
+	Audio      int64  `json:"audio,omitempty"`      // Bytes received, without ID3 tags.
+	Sink       bool   `json:"sink,omitempty"`       // Written to Downloader.Sink, not kept on disk.
+}
+
+// loadState reads the state file from dir. A missing file yields an empty
+// state. When ignore is set no episode counts as complete by the state
+// alone, so every one gets verified again, but the recorded sizes still tell
+// sizeMatches how much audio each download had; a file that can't be read
+// then yields an empty state rather than an error. The state file is written
+// with the given mode.
+func loadState(dir string, ignore bool, mode os.FileMode) (*downloadState, error) {
+	s := &downloadState{
+		path:     filepath.Join(dir, stateFileName),
+		mode:     mode,
+		ignore:   ignore,
+		Episodes: make(map[string]stateEntry),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, s)
+	}
+	if err != nil && ignore {
+		s.Episodes = make(map[string]stateEntry)
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if s.Episodes == nil {
+		s.Episodes = make(map[string]stateEntry)
+	}
+	return s, nil
+}
+
+// isComplete reports whether the episode was recorded as complete and the
+// file on disk still has the recorded name and size. An entry whose download
+// doesn't match the enclosure length the feed now advertises is stale.
+func (s *downloadState) isComplete(ep Episode, path string) bool {
+	if s.ignore {
+		return false
+	}
+	s.mu.Lock()
+	entry, ok := s.Episodes[ep.Number]
+	s.mu.Unlock()
+	if !ok || entry.File != filepath.Base(path) {
+		return false
+	}
+	if entry.Downloaded > 0 && ep.ExpectedSize > 0 && entry.Downloaded != ep.ExpectedSize {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == entry.Size
+}
+
+// downloaded returns the number of bytes received for the episode when it
+// was recorded as complete, or 0 if unknown.
+func (s *downloadState) downloaded(ep Episode) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Episodes[ep.Number].Downloaded
+}
+
+// audio returns the audio size recorded for the episode's download, or 0 if
+// there is none for the file at path or the enclosure length the feed now
+// advertises doesn't match the download.
+func (s *downloadState) audio(ep Episode, path string) int64 {
+	s.mu.Lock()
+	entry, ok := s.Episodes[ep.Number]
+	s.mu.Unlock()
+	if !ok || entry.File != filepath.Base(path) {
+		return 0
+	}
+	if entry.Downloaded > 0 && ep.ExpectedSize > 0 && entry.Downloaded != ep.ExpectedSize {
+		return 0
+	}
+	return entry.Audio
+}
+
+// markComplete records the episode at path as complete and saves the state.
+// downloaded and audio are the number of bytes received before tagging, with
+// and without the enclosure's own ID3 tags; zero keeps the previously
+// recorded counts.
+func (s *downloadState) markComplete(ep Episode, path string, downloaded, audio int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	entry := stateEntry{File: filepath.Base(path), Size: info.Size(), Downloaded: downloaded, Audio: audio}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev := s.Episodes[ep.Number]; downloaded == 0 && prev.File == entry.File {
+		entry.Downloaded, entry.Audio = prev.Downloaded, prev.Audio
+	}
+	if s.Episodes[ep.Number] == entry {
+		return nil // Already recorded.
+	}
+	s.Episodes[ep.Number] = entry
+	return s.save()
+}
+
+// stored reports whether the episode was recorded as written to the sink
+// under the name of path, from an enclosure of the length the feed now
+// advertises.
+func (s *downloadState) stored(ep Episode, path string) bool {
+	if s.ignore {
+		return false
+	}
+	s.mu.Lock()
+	entry, ok := s.Episodes[ep.Number]
+	s.mu.Unlock()
+	if !ok || !entry.Sink || entry.File != filepath.Base(path) {
+		return false
+	}
+	return entry.Downloaded == 0 || ep.ExpectedSize <= 0 || entry.Downloaded == ep.ExpectedSize
+}
+
+// markStored records the episode as written to the sink and saves the state.
+// There is no file on disk to take the size of.
+func (s *downloadState) markStored(ep Episode, path string) error {
+	entry := stateEntry{File: filepath.Base(path), Downloaded: max(ep.ExpectedSize, 0), Sink: true}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Episodes[ep.Number] == entry {
+		return nil
+	}
+	s.Episodes[ep.Number] = entry
+	return s.save()
+}
+
+// forget drops the episode from the state, so the next run checks its file
+// from scratch.
+func (s *downloadState) forget(ep Episode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Episodes[ep.Number]; !ok {
+		return nil
+	}
+	delete(s.Episodes, ep.Number)
+	return s.save()
+}
+
+// save writes the state file. The caller must hold s.mu.
+func (s *downloadState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash can't leave a truncated state.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, s.mode); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
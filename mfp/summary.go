@@ -0,0 +1,84 @@
+package mfp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runStats counts what happened to each episode during a run. The counters
+// are updated from the download goroutines.
+type runStats struct {
+	start      time.Time
+	complete   atomic.Int64 // Already downloaded and tagged.
+	downloaded atomic.Int64
+	retagged   atomic.Int64 // Audio was fine, only the tags were updated.
+	failed     atomic.Int64
+	bytes      atomic.Int64 // Received from the server, including failed attempts.
+
+	mu          sync.Mutex
+	failedSteps []planStep // The steps behind failed.
+}
+
+// fail counts the step as failed.
+func (s *runStats) fail(step planStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed.Add(1)
+	s.failedSteps = append(s.failedSteps, step)
+}
+
+// takeFailed returns the failed steps and stops counting them as failed,
+// so they can be tried again.
+func (s *runStats) takeFailed() []planStep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steps := s.failedSteps
+	s.failedSteps = nil
+	s.failed.Add(-int64(len(steps)))
+	return steps
+}
+
+// failedEpisodes returns the numbers of the failed episodes.
+func (s *runStats) failedEpisodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	numbers := make([]string, len(s.failedSteps))
+	for i, step := range s.failedSteps {
+		numbers[i] = step.ep.Number
+	}
+	return numbers
+}
+
+// logSummary reports the counters once every episode has been processed.
+// Episodes that were never started, because the run was interrupted, count
+// as skipped. The summary is written whatever LogLevel is, so quiet runs
+// still report it. Feed items dropped while loading the feed are listed
+// before it.
+func (d *Downloader) logSummary(s *runStats) {
+	if len(d.Skipped) > 0 {
+		dropped := make([]string, len(d.Skipped))
+		for i, item := range d.Skipped {
+			dropped[i] = fmt.Sprintf("%s (%v)", item.Title, item.Reason)
+		}
+		d.logger().Warn("Feed items dropped", "items", dropped)
+	}
+	processed := s.complete.Load() + s.downloaded.Load() + s.retagged.Load() + s.failed.Load()
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "Run finished", 0)
+	r.Add(
+		"episodes", len(d.Episodes),
+		"complete", s.complete.Load(),
+		"downloaded", s.downloaded.Load(),
+		"retagged", s.retagged.Load(),
+		"skipped", int64(len(d.Episodes))-processed,
+		"failed", s.failed.Load(),
+		"dropped", len(d.Skipped),
+		"bytes", s.bytes.Load(),
+		"elapsed", time.Since(s.start).Round(time.Millisecond),
+	)
+	// Going straight to the handler skips the logger's level check.
+	d.logger().Handler().Handle(context.Background(), r)
+}
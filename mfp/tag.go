@@ -0,0 +1,337 @@
+package mfp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bogem/id3v2"
+)
+
+// canTag reports whether tagEpisode supports the episode's format. Only MP3
+// files carry ID3 tags.
+func canTag(ep Episode) bool {
+	return ep.Ext == "" || ep.Ext == ".mp3"
+}
+
+// untaggable is the error for an episode in StrictTags mode whose format
+// can't be tagged.
+func untaggable(ep Episode) error {
+	return fmt.Errorf("tagging %s files isn't supported", ep.Ext)
+}
+
+// album returns the album tag to write.
+func (d *Downloader) album() string {
+	if d.Album == "" {
+		return DefaultAlbum
+	}
+	return d.Album
+}
+
+// metadataComplete checks that the MP3 file has the configured album and the
+// episode's title, track and artist metadata, and every frame in
+// d.RequiredFrames. With d.CheckCover the embedded cover must be the current
+// one, and with d.StrictTags it also checks every other frame tagEpisode
+// writes for the episode.
+func (d *Downloader) metadataComplete(mp3Path string, ep Episode) (bool, error) {
+	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+	if err != nil {
+		return false, err
+	}
+	defer tag.Close()
+
+	if tag.Album() != d.album() {
+		return false, nil
+	}
+	if tag.Title() != ep.Title || tag.GetTextFrame("TRCK").Text != ep.Number {
+		return false, nil
+	}
+	if ep.Artist != "" && tag.Artist() != ep.Artist {
+		return false, nil
+	}
+	required := d.RequiredFrames
+	if required == nil {
+		required = DefaultRequiredFrames
+	}
+	for _, id := range required {
+		if id == "APIC" && d.NoCover {
+			continue
+		}
+		if len(tag.GetFrames(id)) == 0 {
+			return false, nil
+		}
+	}
+	if d.CheckCover && !d.NoCover && !d.coverCurrent(tag, ep) {
+		return false, nil
+	}
+	if d.StrictTags {
+		return d.strictFramesComplete(tag, ep), nil
+	}
+	return true, nil
+}
+
+// strictFramesComplete checks the frames that are only required in
+// StrictTags mode: the cover unless d.NoCover is set, and the album artist,
+// the date and the notes, if the feed provides them.
+func (d *Downloader) strictFramesComplete(tag *id3v2.Tag, ep Episode) bool {
+	if !d.NoCover && !hasFrontCover(tag) {
+		return false
+	}
+	if ep.AlbumArtist != "" && tag.GetTextFrame("TPE2").Text != ep.AlbumArtist {
+		return false
+	}
+	if ep.Published != nil && tag.GetTextFrame("TDRC").Text != ep.Published.Format("2006-01-02") {
+		return false
+	}
+	if d.comment(ep) != "" && len(tag.GetFrames(tag.CommonID("Comments"))) == 0 {
+		return false
+	}
+	return true
+}
+
+// comment returns the comment tag for the episode: its notes, followed by
+// the enclosure URL when d.CommentURL is set.
+func (d *Downloader) comment(ep Episode) string {
+	if !d.CommentURL {
+		return ep.Description
+	}
+	source := "Source: " + redactURL(ep.URL)
+	if ep.Description == "" {
+		return source
+	}
+	return ep.Description + "\n\n" + source
+}
+
+// errNotMP3 reports a download that doesn't look like MP3 audio, typically
+// an error page served with a success status.
+var errNotMP3 = errors.New("downloaded file is not valid MP3")
+
+// checkMP3 returns errNotMP3 unless audio, the first bytes after the ID3v2
+// tag if there is one, starts with an MPEG audio frame sync (11 set bits).
+func checkMP3(audio []byte) error {
+	if len(audio) < 2 || audio[0] != 0xFF || audio[1]&0xE0 != 0xE0 {
+		return fmt.Errorf("%w: it starts with %q", errNotMP3, audio)
+	}
+	return nil
+}
+
+// audioWriter passes an MP3 enclosure on to w without its ID3 tags, so
+// the file carries only the tags written for the episode, and checks it
+// with checkMP3 on the way. The ID3v2 tag is dropped from the start; with
+// trimV1, the last id3v1Size bytes are held back until finish, which drops
+// them if they are an ID3v1 tag.
+type audioWriter struct {
+	w      io.Writer
+	trimV1 bool
+	skip   int64  // ID3v2 bytes left to drop, -1 until the header is in.
+	head   []byte // Bytes received before the header was complete.
+	tail   []byte // Bytes held back for trimV1.
+	sync   []byte // The first two audio bytes, for checkMP3.
+	n      int64  // Audio bytes written to w.
+}
+
+func (a *audioWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if a.skip < 0 {
+		a.head = append(a.head, p...)
+		if len(a.head) < 10 {
+			return n, nil
+		}
+		a.skip, p, a.head = tagSizeFromHeader(a.head), a.head, nil
+	}
+	drop := min(a.skip, int64(len(p)))
+	a.skip -= drop
+	if err := a.hold(p[drop:]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// hold writes audio on to w, keeping the last id3v1Size bytes back with
+// trimV1.
+func (a *audioWriter) hold(p []byte) error {
+	if !a.trimV1 {
+		return a.writeAudio(p)
+	}
+	a.tail = append(a.tail, p...)
+	extra := len(a.tail) - id3v1Size
+	if extra <= 0 {
+		return nil
+	}
+	err := a.writeAudio(a.tail[:extra])
+	a.tail = append(a.tail[:0], a.tail[extra:]...)
+	return err
+}
+
+func (a *audioWriter) writeAudio(p []byte) error {
+	if len(a.sync) < 2 && a.n < 2 {
+		a.sync = append(a.sync, p[:min(len(p), 2-len(a.sync))]...)
+		if len(a.sync) == 2 {
+			if err := checkMP3(a.sync); err != nil {
+				return err
+			}
+		}
+	}
+	n, err := a.w.Write(p)
+	a.n += int64(n)
+	return err
+}
+
+// finish writes out what was held back, with v1 in place of the
+// enclosure's ID3v1 tag.
+func (a *audioWriter) finish(v1 []byte) error {
+	if a.skip < 0 {
+		// Too short for an ID3v2 header, so it's all audio.
+		a.skip = 0
+		if err := a.hold(a.head); err != nil {
+			return err
+		}
+	}
+	if len(a.tail) == id3v1Size && string(a.tail[:3]) == "TAG" {
+		a.tail = nil
+	}
+	if err := a.writeAudio(a.tail); err != nil {
+		return err
+	}
+	if a.n < 2 {
+		return checkMP3(a.sync)
+	}
+	_, err := a.w.Write(v1)
+	return err
+}
+
+// needsTagging reports whether tagEpisode would change the file at path.
+// Rewriting a large file is costly, so it is skipped when the tags are
+// already complete.
+func (d *Downloader) needsTagging(path string, ep Episode) bool {
+	if complete, err := d.metadataComplete(path, ep); err != nil || !complete {
+		return true
+	}
+	if d.ID3v1 {
+		if size, err := id3v1TagSize(path); err != nil || size == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tagEpisode applies the episode metadata and, unless d.NoCover is set, the
+// cover image to the MP3 file, and an ID3v1 tag for legacy players when
+// d.ID3v1 is set.
+func (d *Downloader) tagEpisode(mp3Path, coverPath string, ep Episode) error {
+	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+
+	if err := d.setFrames(tag, coverPath, ep); err != nil {
+		return err
+	}
+	if err := d.saveTag(tag, mp3Path); err != nil {
+		return err
+	}
+	if d.ID3v1 {
+		if err := writeID3v1(mp3Path, d.album(), ep); err != nil {
+			return err
+		}
+	}
+	if d.StrictTags {
+		// Make sure what was written reads back in full.
+		complete, err := d.metadataComplete(mp3Path, ep)
+		if err != nil {
+			return fmt.Errorf("failed to read back tags: %w", err)
+		}
+		if !complete {
+			return errors.New("tags are incomplete after writing them")
+		}
+	}
+	return nil
+}
+
+// encodeTag returns the ID3v2 tag tagEpisode would write for the episode,
+// followed by d.TagPadding bytes of padding so a later retag fits in place.
+func (d *Downloader) encodeTag(coverPath string, ep Episode) ([]byte, error) {
+	tag := id3v2.NewEmptyTag()
+	defer tag.Close()
+	if err := d.setFrames(tag, coverPath, ep); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := tag.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	if padding := d.TagPadding; padding > 0 {
+		buf.Write(make([]byte, max(padding, minPadding)))
+	}
+	encoded := buf.Bytes()
+	putTagSize(encoded, int64(len(encoded))-10)
+	return encoded, nil
+}
+
+// setFrames sets the episode metadata and, unless d.NoCover is set, the
+// cover image on tag.
+func (d *Downloader) setFrames(tag *id3v2.Tag, coverPath string, ep Episode) error {
+	tag.SetAlbum(d.album())
+	tag.SetTitle(ep.Title)
+	tag.AddTextFrame("TRCK", tag.DefaultEncoding(), ep.Number)
+	if ep.Artist != "" {
+		tag.SetArtist(ep.Artist)
+	}
+	if ep.AlbumArtist != "" {
+		tag.AddTextFrame("TPE2", tag.DefaultEncoding(), ep.AlbumArtist)
+	}
+	// The comment is rebuilt from the feed every time, so re-tagging
+	// replaces it rather than appending the source URL again.
+	if comment := d.comment(ep); comment != "" {
+		tag.AddCommentFrame(id3v2.CommentFrame{
+			Encoding: id3v2.EncodingUTF8,
+			Language: "eng",
+			Text:     comment,
+		})
+	}
+	if ep.Duration > 0 {
+		// TLEN is the length in milliseconds.
+		tag.AddTextFrame("TLEN", tag.DefaultEncoding(), strconv.FormatInt(ep.Duration.Round(time.Millisecond).Milliseconds(), 10))
+	}
+	if ep.Published != nil {
+		tag.AddTextFrame("TYER", tag.DefaultEncoding(), ep.Published.Format("2006"))
+		tag.AddTextFrame("TDRC", tag.DefaultEncoding(), ep.Published.Format("2006-01-02"))
+	}
+
+	if !d.NoCover {
+		cover, err := os.ReadFile(coverPath)
+		if err != nil {
+			return err
+		}
+		pic := id3v2.PictureFrame{
+			Encoding:    id3v2.EncodingUTF8,
+			MimeType:    http.DetectContentType(cover),
+			PictureType: id3v2.PTFrontCover,
+			Description: "Cover",
+			Picture:     cover,
+		}
+		// Drop any front cover the file already has, e.g. the enclosure's
+		// own under another description, so ours is the only one.
+		pictures := tag.GetFrames("APIC")
+		tag.DeleteFrames("APIC")
+		for _, f := range pictures {
+			if p, ok := f.(id3v2.PictureFrame); !ok || p.PictureType != id3v2.PTFrontCover {
+				tag.AddFrame("APIC", f)
+			}
+		}
+		tag.AddAttachedPicture(pic)
+		for _, art := range d.artwork {
+			tag.AddAttachedPicture(art)
+		}
+	}
+	if len(ep.Chapters) > 0 {
+		addChapterFrames(tag, ep)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package mfp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bogem/id3v2"
+)
+
+func TestTagEpisodeReplacesFrontCover(t *testing.T) {
+	d := newTestDownloader(t, "")
+	d.CheckCover = true
+	cover := pngImage(t, 200)
+	sum := sha256.Sum256(cover)
+	d.coverSum = sum[:]
+	coverPath := writeFile(t, t.TempDir(), "cover.png", cover)
+
+	// The enclosure ships its own front cover, under another description
+	// than ours, and a back cover.
+	path := writeFile(t, d.OutputDir, "01 - First.mp3", fakeMP3(10000))
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pic := range []id3v2.PictureFrame{
+		{Encoding: id3v2.EncodingUTF8, MimeType: "image/png", PictureType: id3v2.PTFrontCover, Description: "Host cover", Picture: pngImage(t, 10)},
+		{Encoding: id3v2.EncodingUTF8, MimeType: "image/png", PictureType: id3v2.PTBackCover, Description: "Back", Picture: pngImage(t, 20)},
+	} {
+		tag.AddAttachedPicture(pic)
+	}
+	if err := tag.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tag.Close()
+
+	ep := Episode{Number: "01", Title: "First", Artist: "Test Artist"}
+	for run := 1; run <= 2; run++ {
+		if err := d.tagEpisode(path, coverPath, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tag, err = id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	var front, back int
+	for _, f := range tag.GetFrames("APIC") {
+		switch pic := f.(id3v2.PictureFrame); pic.PictureType {
+		case id3v2.PTFrontCover:
+			front++
+			if !bytes.Equal(pic.Picture, cover) {
+				t.Errorf("front cover %q isn't the saved cover", pic.Description)
+			}
+		case id3v2.PTBackCover:
+			back++
+		}
+	}
+	if front != 1 || back != 1 {
+		t.Errorf("got %d front and %d back covers, want 1 and 1", front, back)
+	}
+	if complete, err := d.metadataComplete(path, ep); err != nil || !complete {
+		t.Errorf("metadataComplete = %v, %v, want true", complete, err)
+	}
+}
@@ -0,0 +1,157 @@
+package mfp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Verify re-checks the episodes already in the output directory and re-tags
+// any that are missing metadata or the cover, checking as many files at once
+// as a run tags. It never downloads audio, so
+// files tagged by an older version can be repaired in place; files shorter
+// than the enclosure are reported and left for the next run to download.
+func (d *Downloader) Verify(ctx context.Context) error {
+	if err := d.prepareOutput(); err != nil {
+		return fmt.Errorf("failed to prepare output directory: %w", err)
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.fetchCover(ctx); err != nil {
+		return err
+	}
+	if err := d.loadEpisodes(ctx); err != nil {
+		return err
+	}
+	state, err := loadState(d.OutputDir, false, d.fileMode())
+	if err != nil {
+		return err
+	}
+	d.state = state
+	sums, err := loadChecksums(d.OutputDir, d.fileMode())
+	if err != nil {
+		return err
+	}
+	d.sums = sums
+
+	log := d.logger()
+	coverPath := d.coverPath()
+	workers := d.workers()
+	if d.TagConcurrency > 0 {
+		workers = d.TagConcurrency
+	}
+	sem := make(slots, workers)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[verifyResult][]string)
+	)
+	for _, ep := range d.Episodes {
+		if !sem.acquire(ctx) {
+			break
+		}
+		wg.Add(1)
+		go func(ep Episode) {
+			defer wg.Done()
+			defer sem.release()
+			fileName := d.episodePath(ep)
+			result := d.verifyEpisode(ctx, ep, fileName, coverPath)
+			mu.Lock()
+			results[result] = append(results[result], fileName)
+			mu.Unlock()
+		}(ep)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, files := range results {
+		sort.Strings(files)
+	}
+	truncated, failed := len(results[verifyTruncated]), len(results[verifyFailed])
+	checked := len(results[verifyOK]) + len(results[verifyRepaired]) + truncated + failed
+	if truncated > 0 {
+		log.Warn("Truncated files", "files", results[verifyTruncated])
+	}
+	if failed > 0 {
+		log.Error("Files that could not be repaired", "files", results[verifyFailed])
+	}
+	log.Info("Verification finished", "checked", checked, "repaired", len(results[verifyRepaired]), "truncated", truncated, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d files could not be repaired", ErrEpisodesFailed, failed, checked)
+	}
+	if truncated > 0 {
+		return fmt.Errorf("%w: %d of %d files are truncated", ErrEpisodesFailed, truncated, checked)
+	}
+	return nil
+}
+
+// verifyResult is the outcome of verifyEpisode.
+type verifyResult int
+
+const (
+	verifyMissing   verifyResult = iota // No file to check.
+	verifyOK                            // Complete, nothing to do.
+	verifyRepaired                      // Re-tagged.
+	verifyTruncated                     // Shorter than the enclosure.
+	verifyFailed                        // Couldn't be checked or repaired.
+)
+
+// verifyEpisode checks one episode's file and re-tags it if its metadata is
+// incomplete. Problems are logged as they are found.
+func (d *Downloader) verifyEpisode(ctx context.Context, ep Episode, fileName, coverPath string) verifyResult {
+	log := d.logger()
+	path := filepath.Join(d.OutputDir, fileName)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return verifyMissing
+	}
+
+	// Tags can be intact on a file whose download was cut short.
+	sizeOk, err := d.sizeMatches(ctx, ep, path)
+	if err != nil {
+		log.Warn("Error checking file size", "file", fileName, "err", err)
+	} else if !sizeOk {
+		log.Warn("File is truncated, it will be downloaded again on the next run", "file", fileName)
+		if err := d.state.forget(ep); err != nil {
+			log.Error("Error saving state", "episode", ep.Number, "err", err)
+		}
+		return verifyTruncated
+	}
+	if !canTag(ep) {
+		if d.StrictTags {
+			log.Error("Error repairing metadata", "file", fileName, "err", untaggable(ep))
+			return verifyFailed
+		}
+		return verifyOK
+	}
+	complete, err := d.metadataComplete(path, ep)
+	if err != nil {
+		log.Warn("Error reading metadata, re-tagging", "file", fileName, "err", err)
+	}
+	if complete {
+		return verifyOK
+	}
+	if d.Chapters {
+		ep.Chapters = d.episodeChapters(ctx, ep, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Error("Error repairing metadata", "file", fileName, "err", err)
+		return verifyFailed
+	}
+	if err := d.tagEpisode(path, d.episodeCover(ctx, ep, coverPath), ep); err != nil {
+		log.Error("Error repairing metadata", "file", fileName, "err", err)
+		return verifyFailed
+	}
+	d.setModTime(ep, path, info.ModTime())
+	log.Info("Metadata repaired", "file", fileName)
+	d.recordChecksum(fileName, nil)
+	return verifyRepaired
+}
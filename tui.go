@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidroman0O/go-musicforprogramming/mfp"
+)
+
+// dashboardLogLines is the number of log lines kept in the log pane.
+const dashboardLogLines = 8
+
+// dashboardInterval is how often the dashboard is redrawn.
+const dashboardInterval = 250 * time.Millisecond
+
+// transfer is the dashboard's view of one active episode.
+type transfer struct {
+	phase        mfp.Phase
+	bytes, total int64
+}
+
+// dashboard is the -tui display: a bar per active download, the overall
+// progress and speed, and the latest log lines below them. It takes over the
+// terminal with the alternate screen while the run lasts and is fed by
+// Downloader.Progress; it also serves as the Downloader's LogOutput.
+type dashboard struct {
+	mu       sync.Mutex
+	out      io.Writer
+	active   map[string]*transfer
+	order    []string // Active episodes, in the order they started.
+	complete int
+	failed   map[string]bool // Failed episodes; Run may retry them.
+	bytes    int64           // Bytes of the episodes that are no longer active.
+	logs     []string
+	partial  []byte // Log output after the last newline.
+
+	start     time.Time
+	lastBytes int64
+	lastTick  time.Time
+	speed     float64 // Bytes per second over the last interval.
+
+	events chan mfp.ProgressEvent
+	done   chan struct{}
+}
+
+// newDashboard switches out to the alternate screen and starts drawing. The
+// returned dashboard must be closed to restore the terminal.
+func newDashboard(out io.Writer) *dashboard {
+	now := time.Now()
+	t := &dashboard{
+		out:      out,
+		active:   make(map[string]*transfer),
+		failed:   make(map[string]bool),
+		start:    now,
+		lastTick: now,
+		events:   make(chan mfp.ProgressEvent, 64),
+		done:     make(chan struct{}),
+	}
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	go t.run()
+	return t
+}
+
+// canDraw reports whether f is a terminal, which the dashboard needs.
+func canDraw(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// Write adds log output to the log pane.
+func (t *dashboard) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.logs = append(t.logs, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.logs) > dashboardLogLines {
+		t.logs = t.logs[len(t.logs)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// run applies progress events and redraws until Close.
+func (t *dashboard) run() {
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-t.events:
+			if !ok {
+				close(t.done)
+				return
+			}
+			t.update(ev)
+		case <-ticker.C:
+			t.draw()
+		}
+	}
+}
+
+// update records one progress event.
+func (t *dashboard) update(ev mfp.ProgressEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.active[ev.Episode]
+	switch ev.Phase {
+	case mfp.PhaseComplete, mfp.PhaseError:
+		if ev.Phase == mfp.PhaseComplete {
+			t.complete++
+			delete(t.failed, ev.Episode)
+		} else {
+			t.failed[ev.Episode] = true
+		}
+		if ok {
+			t.bytes += tr.bytes
+			delete(t.active, ev.Episode)
+			for i, n := range t.order {
+				if n == ev.Episode {
+					t.order = append(t.order[:i], t.order[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if !ok {
+		tr = &transfer{}
+		t.active[ev.Episode] = tr
+		t.order = append(t.order, ev.Episode)
+	}
+	tr.phase = ev.Phase
+	if ev.Phase == mfp.PhaseDownloading {
+		tr.bytes, tr.total = ev.Bytes, ev.Total
+	}
+}
+
+// draw redraws the whole screen from the top left corner.
+func (t *dashboard) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	received := t.bytes
+	for _, tr := range t.active {
+		received += tr.bytes
+	}
+	if elapsed := now.Sub(t.lastTick).Seconds(); elapsed > 0 {
+		t.speed = float64(received-t.lastBytes) / elapsed
+	}
+	t.lastBytes, t.lastTick = received, now
+
+	width := terminalWidth()
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		if len(s) > width {
+			s = s[:width]
+		}
+		b.WriteString(s + "\x1b[K\n")
+	}
+	line("Music For Programming - %s elapsed", now.Sub(t.start).Round(time.Second))
+	line("%d complete, %d failed, %d active - %s received, %s/s",
+		t.complete, len(t.failed), len(t.active), formatBytes(received), formatBytes(int64(t.speed)))
+	line("")
+	for _, n := range t.order {
+		tr := t.active[n]
+		label := fmt.Sprintf("Episode %-4s", n)
+		if tr.phase == mfp.PhaseTagging {
+			line("%s tagging", label)
+			continue
+		}
+		line("%s %s %s", label, progressBar(tr.bytes, tr.total, width/3), transferSize(tr))
+	}
+	line("")
+	line("Log:")
+	for _, l := range t.logs {
+		line("  %s", l)
+	}
+	b.WriteString("\x1b[J")
+	io.WriteString(t.out, b.String())
+}
+
+// Close stops drawing, restores the terminal and prints the log pane's
+// lines, so the final summary stays visible after the dashboard is gone.
+func (t *dashboard) Close() {
+	close(t.events)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	for _, l := range t.logs {
+		fmt.Fprintln(t.out, l)
+	}
+	if len(t.partial) > 0 {
+		fmt.Fprintln(t.out, string(t.partial))
+	}
+}
+
+// terminalWidth returns $COLUMNS, or 80 if it isn't set.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		return n
+	}
+	return 80
+}
+
+// progressBar draws a bar of width cells filled to n out of total, or an
+// empty one if the total is unknown.
+func progressBar(n, total int64, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = int(min(n, total) * int64(width) / total)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+// transferSize formats an episode's progress as "received / total".
+func transferSize(tr *transfer) string {
+	if tr.total <= 0 {
+		return formatBytes(tr.bytes)
+	}
+	return fmt.Sprintf("%s / %s %3d%%", formatBytes(tr.bytes), formatBytes(tr.total), min(tr.bytes, tr.total)*100/tr.total)
+}
+
+// formatBytes formats n with a binary unit, e.g. 1.5 MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}